@@ -274,7 +274,7 @@ func main() {
 
 	fmt.Printf("\n\nFinished file processing, awaiting responses / user termination\n\n")
 
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	s := <-sig
 	fmt.Printf("Signal (%s) received, stopping\n", s)
@@ -10,6 +10,16 @@
 //
 //   queryuploader --clusterIPs 192.168.0.2,192.168.0.3 --db cassandra --useZones --dd ./zones
 //
+// The backend and its driver options can also be read from the same
+// configuration file used by the server:
+//
+//   queryuploader --config kvsdns.yml --df ./file
+//
+// The records are uploaded in batches of --batch records, at most --rate
+// records per second, and the throughput logged every --report:
+//
+//   queryuploader --config kvsdns.yml --df ./file --routines 4 --batch 500 --rate 20000
+//
 // NB: add the necessary ports for each redis and etcd server.
 // Consider this operation very taxing for a large dataset
 //
@@ -17,27 +27,36 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/dario617/goKvsDns/internal/config"
 	"github.com/dario617/goKvsDns/internal/server"
 	"github.com/dario617/goKvsDns/internal/utils"
+	"github.com/miekg/dns"
 )
 
 var (
+	configFile    = flag.String("config", "", "YAML configuration file")
+	checkConfig   = flag.Bool("check-config", false, "validate the configuration and exit")
 	datasetFile   = flag.String("df", "./data/dataset/dns-rr.txt", "File to read RR from")
 	useZones      = flag.Bool("useZones", false, "use Zones instead of a RR list file")
 	datasetFolder = flag.String("dd", "./data/zones", "Directory containing zones")
 	db            = flag.String("db", "cassandra", "db to connect: cassandra|redis|etcd")
 	clusterIPs    = flag.String("clusterIPs", "192.168.0.240,192.168.0.241,192.168.0.242", "comma separated IP list")
 	routines      = flag.Int("routines", 1, "number of subroutines")
+	batchSize     = flag.Int("batch", 1000, "records per batch upload, 1 uploads them one by one")
+	rate          = flag.Int("rate", 0, "records per second to upload at most, 0 for no limit")
+	reportTime    = flag.Duration("report", 10*time.Second, "interval between throughput reports")
 	verbose       = flag.Bool("v", false, "Print to stdout progress and logs")
 )
 
@@ -70,7 +89,9 @@ func readFile(ch chan string, name string, wg *sync.WaitGroup) {
 
 	wg.Done()
 	// When upload is complete exit
+	close(ch)
 	wg.Wait()
+	progress.report()
 }
 
 func readZones(ch chan string, name string, wg *sync.WaitGroup) {
@@ -102,20 +123,126 @@ func readZones(ch chan string, name string, wg *sync.WaitGroup) {
 	// When upload is complete exit
 	close(ch)
 	wg.Wait()
+	progress.report()
 }
 
 func uploadWorker(driver server.DBDriver, lines chan string, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	log.Println("Started goroutine")
+	if *batchSize > 1 {
+		batchWorker(driver, lines)
+		return
+	}
 	for l := range lines {
-		err := driver.UploadRR(l)
+		limit.wait(1)
+		err := driver.UploadRR(context.Background(), l)
 		if err != nil && *verbose {
 			log.Printf("Error uploading %s: %v", l, err)
 		}
+		progress.add(1, err != nil)
+	}
+}
+
+// batchWorker uploads the lines in batches of batchSize records
+func batchWorker(driver server.DBDriver, lines chan string) {
+	batch := make([]dns.RR, 0, *batchSize)
+	upload := func() {
+		limit.wait(len(batch))
+		err := driver.UploadBatch(context.Background(), batch)
+		var batchErr *server.BatchError
+		switch {
+		case errors.As(err, &batchErr):
+			if *verbose {
+				for _, failed := range batchErr.Failed {
+					log.Printf("Error uploading %s: %v", failed.RR, failed.Err)
+				}
+			}
+			progress.add(len(batch)-len(batchErr.Failed), false)
+			progress.add(len(batchErr.Failed), true)
+		case err != nil:
+			log.Printf("Error uploading a batch of %d records: %v", len(batch), err)
+			progress.add(len(batch), true)
+		default:
+			progress.add(len(batch), false)
+		}
+		batch = batch[:0]
+	}
+
+	for l := range lines {
+		rr, err := server.ParseRecord(l)
+		if err != nil {
+			if *verbose {
+				log.Printf("Error parsing %s: %v", l, err)
+			}
+			progress.add(1, true)
+			continue
+		}
+		if batch = append(batch, rr); len(batch) == *batchSize {
+			upload()
+		}
+	}
+	if len(batch) > 0 {
+		upload()
+	}
+}
+
+// uploadProgress counts the records uploaded to report the throughput
+type uploadProgress struct {
+	start    time.Time
+	uploaded int64
+	failed   int64
+}
+
+var progress = &uploadProgress{start: time.Now()}
+
+func (p *uploadProgress) add(records int, failed bool) {
+	if failed {
+		atomic.AddInt64(&p.failed, int64(records))
+	} else {
+		atomic.AddInt64(&p.uploaded, int64(records))
+	}
+}
+
+func (p *uploadProgress) report() {
+	uploaded := atomic.LoadInt64(&p.uploaded)
+	elapsed := time.Since(p.start)
+	log.Printf("Uploaded %d records, %d failed, in %v (%.0f records/s)",
+		uploaded, atomic.LoadInt64(&p.failed), elapsed.Round(time.Second), float64(uploaded)/elapsed.Seconds())
+}
+
+// reportEvery logs the throughput every interval
+func (p *uploadProgress) reportEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.report()
 	}
 }
 
+// rateLimit spaces the uploads to keep under rate records per second
+type rateLimit struct {
+	mu   sync.Mutex
+	rate int
+	next time.Time
+}
+
+var limit = &rateLimit{}
+
+// wait blocks until records can be uploaded
+func (l *rateLimit) wait(records int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(records) * time.Second / time.Duration(l.rate))
+	l.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
 func main() {
 
 	flag.Usage = func() {
@@ -123,49 +250,48 @@ func main() {
 	}
 	flag.Parse()
 
-	var wg sync.WaitGroup
-
-	// Create channel and open file
-	// The following routines will call for a halt when they are done
-	// or die unexpectedly on a bad line
-	lines := make(chan string)
-	if *useZones {
-		wg.Add(1)
-		go readZones(lines, *datasetFolder, &wg)
-	} else {
-		wg.Add(1)
-		go readFile(lines, *datasetFile, &wg)
+	cfg, err := config.FromFlags(*configFile, flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *checkConfig {
+		log.Println("Configuration OK")
+		return
 	}
 
 	// Connect to db
-	var driver server.DBDriver
-	switch *db {
-	case "cassandra":
-		var d *server.CassandraDB = new(server.CassandraDB)
-		d.Print = *verbose
-		driver = d
-	case "redis":
-		var d *server.RedisKVS = new(server.RedisKVS)
-		d.Print = *verbose
-		driver = d
-	case "etcd":
-		var d *server.EtcdDB = new(server.EtcdDB)
-		d.Print = *verbose
-		d.Timeout = 5 * time.Second
-		driver = d
-	}
-
-	driver.ConnectDB(strings.Split(*clusterIPs, ","))
-	log.Printf("DB %s connected for cluster %v\n", *db, *clusterIPs)
+	driver := server.NewDriver(cfg.Backend, *verbose)
+	if zoned, ok := driver.(server.ZoneAware); ok {
+		zoned.SetZones(cfg.ZoneNames())
+	}
+	driver.ConnectDB(cfg.Backend.ClusterIPs)
+	log.Printf("DB %s connected for cluster %v\n", cfg.Backend.DB, cfg.Backend.ClusterIPs)
 	defer driver.Disconnect()
 
+	var wg sync.WaitGroup
+
+	// The buffer holds a batch per worker, readers wait while it's full.
+	// The workers are added first so the reader waits for them to upload
+	// everything before exiting
+	lines := make(chan string, *routines**batchSize)
+	limit.rate = *rate
+	go progress.reportEvery(*reportTime)
 	for i := 0; i < *routines; i++ {
 		wg.Add(1)
 		go uploadWorker(driver, lines, &wg)
 	}
 
+	// Open the file, the reader calls for a halt when the upload is done
+	// or dies unexpectedly on a bad line
+	wg.Add(1)
+	if *useZones {
+		go readZones(lines, *datasetFolder, &wg)
+	} else {
+		go readFile(lines, *datasetFile, &wg)
+	}
+
 	// Manual process termination
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	s := <-sig
 	log.Printf("Signal (%s) received, stopping\n", s)
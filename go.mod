@@ -7,13 +7,17 @@ require (
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
 	github.com/coreos/pkg v0.0.0-20180928190104-399ea9e2e55f // indirect
+	github.com/dnstap/golang-dnstap v0.4.0
 	github.com/go-redis/redis v6.15.7+incompatible
 	github.com/gocql/gocql v0.0.0-20200511135441-57b003a04490
 	github.com/gogo/protobuf v1.3.1 // indirect
 	github.com/google/uuid v1.1.1 // indirect
-	github.com/miekg/dns v1.1.29
+	github.com/miekg/dns v1.1.50
 	github.com/onsi/ginkgo v1.12.2 // indirect
 	go.etcd.io/etcd v3.3.20+incompatible
 	go.uber.org/zap v1.15.0 // indirect
-	google.golang.org/grpc v1.26.0 // indirect
-)
\ No newline at end of file
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	google.golang.org/grpc v1.26.0
+	google.golang.org/protobuf v1.23.0
+	gopkg.in/yaml.v2 v2.3.0
+)
@@ -0,0 +1,748 @@
+// Package config loads and validates the YAML configuration shared by
+// the DNS server and the tools under cmd.
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// Config : whole configuration of a goKvsDns instance
+type Config struct {
+	Listen  Listen    `yaml:"listen"`
+	Backend Backend   `yaml:"backend"`
+	Zones   []Zone    `yaml:"zones"`
+	ACL     ACL       `yaml:"acl"`
+	TSIG    []TSIGKey `yaml:"tsig"`
+	Logging Logging   `yaml:"logging"`
+	RRL     RRL       `yaml:"rrl"`
+	Metrics string    `yaml:"metrics"`
+	Health  Health    `yaml:"health"`
+	Cache   Cache     `yaml:"cache"`
+}
+
+// Listen : DNS listeners
+type Listen struct {
+	Port      int `yaml:"port"`
+	ReusePort int `yaml:"reuseport"`
+	CPU       int `yaml:"cpu"`
+	// Time given to the queries in flight to finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+// Backend : database used to store the records and its driver options
+type Backend struct {
+	DB         string   `yaml:"db"`
+	ClusterIPs []string `yaml:"clusterIPs"`
+	// Deadline of each query made to answer a request
+	QueryTimeout time.Duration `yaml:"queryTimeout"`
+	Cassandra    Cassandra     `yaml:"cassandra"`
+	Redis        Redis         `yaml:"redis"`
+	Etcd         Etcd          `yaml:"etcd"`
+}
+
+// Cassandra : gocql cluster options
+type Cassandra struct {
+	Keyspace string `yaml:"keyspace"`
+	// Consistency of the reads and writes whose own one isn't set
+	Consistency      string `yaml:"consistency"`
+	ReadConsistency  string `yaml:"readConsistency"`
+	WriteConsistency string `yaml:"writeConsistency"`
+	// Datacenter preferred for the requests, others are used as fallback
+	LocalDC        string        `yaml:"localDC"`
+	Timeout        time.Duration `yaml:"timeout"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	NumConns       int           `yaml:"numConns"`
+	// Writes are tried up to WriteAttempts times and reads retried
+	// ReadRetries times, waiting an exponential backoff with jitter
+	// between MinBackoff and MaxBackoff
+	WriteAttempts int           `yaml:"writeAttempts"`
+	ReadRetries   int           `yaml:"readRetries"`
+	MinBackoff    time.Duration `yaml:"minBackoff"`
+	MaxBackoff    time.Duration `yaml:"maxBackoff"`
+	// Reads also sent to other replicas when one doesn't answer within
+	// SpeculativeDelay, 0 attempts disables it
+	SpeculativeAttempts int           `yaml:"speculativeAttempts"`
+	SpeculativeDelay    time.Duration `yaml:"speculativeDelay"`
+	// Batch uploads write unlogged batches of up to BatchSize statements
+	// of a partition, BatchConcurrency at a time
+	BatchSize        int `yaml:"batchSize"`
+	BatchConcurrency int `yaml:"batchConcurrency"`
+	// Create or migrate the schema when connecting
+	Migrate     bool        `yaml:"migrate"`
+	Replication Replication `yaml:"replication"`
+	// PasswordAuthenticator credentials and client TLS
+	Auth Auth `yaml:"auth"`
+	TLS  TLS  `yaml:"tls"`
+	// Data model: records, a partition per name and type, or zones, a
+	// partition per zone which needs the zones to be configured
+	Model string `yaml:"model"`
+}
+
+// Replication : strategy of the keyspace when it is created. SimpleStrategy
+// uses Factor, NetworkTopologyStrategy the factor of each datacenter
+type Replication struct {
+	Class       string         `yaml:"class"`
+	Factor      int            `yaml:"factor"`
+	DataCenters map[string]int `yaml:"dataCenters"`
+}
+
+// Redis : go-redis cluster options, zero values keep the library defaults
+type Redis struct {
+	PoolSize     int           `yaml:"poolSize"`
+	MaxRedirects int           `yaml:"maxRedirects"`
+	DialTimeout  time.Duration `yaml:"dialTimeout"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	// Data model: keys, a string per name and type, or hashes, a hash per
+	// name tagged with its zone which needs the zones to be configured
+	Model string `yaml:"model"`
+	// Commands sent in each pipeline of the batch uploads
+	PipelineSize int `yaml:"pipelineSize"`
+	// Deployment: cluster, sentinel or standalone. clusterIPs are the
+	// sentinels in sentinel mode and the primary followed by its replicas
+	// in standalone mode
+	Mode       string `yaml:"mode"`
+	MasterName string `yaml:"masterName"`
+	// Reads go to the replicas, the closest one with RouteByLatency and a
+	// random one otherwise. Outside cluster mode the primary only takes
+	// them when no replica answers
+	ReadFromReplicas bool `yaml:"readFromReplicas"`
+	RouteByLatency   bool `yaml:"routeByLatency"`
+	// Password, or ACL user and password, and client TLS of the nodes and
+	// the sentinels
+	Auth Auth `yaml:"auth"`
+	TLS  TLS  `yaml:"tls"`
+}
+
+// Etcd : clientv3 options
+type Etcd struct {
+	Timeout     time.Duration `yaml:"timeout"`
+	DialTimeout time.Duration `yaml:"dialTimeout"`
+	// Must not exceed the --max-txn-ops and --max-request-bytes of the cluster
+	MaxTxnOps       int `yaml:"maxTxnOps"`
+	MaxRequestBytes int `yaml:"maxRequestBytes"`
+	// Transactions that conflict with another writer are tried up to
+	// WriteAttempts times, waiting an exponential backoff with jitter
+	// between MinBackoff and MaxBackoff
+	WriteAttempts int           `yaml:"writeAttempts"`
+	MinBackoff    time.Duration `yaml:"minBackoff"`
+	MaxBackoff    time.Duration `yaml:"maxBackoff"`
+	// User of the etcd auth and client certificate TLS
+	Auth Auth `yaml:"auth"`
+	TLS  TLS  `yaml:"tls"`
+}
+
+// Auth : credentials of a backend. The password is given inline, read
+// from PasswordFile or from the PasswordEnv environment variable
+type Auth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+	PasswordEnv  string `yaml:"passwordEnv"`
+}
+
+// Secret : password from the configured source, "" when none is set.
+// Trailing newlines of the file are removed
+func (a Auth) Secret() (string, error) {
+	switch {
+	case a.PasswordFile != "":
+		data, err := ioutil.ReadFile(a.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case a.PasswordEnv != "":
+		secret, ok := os.LookupEnv(a.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", a.PasswordEnv)
+		}
+		return secret, nil
+	}
+	return a.Password, nil
+}
+
+func (a Auth) validate() error {
+	sources := 0
+	for _, source := range []string{a.Password, a.PasswordFile, a.PasswordEnv} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("only one of password, passwordFile and passwordEnv can be set")
+	}
+	_, err := a.Secret()
+	return err
+}
+
+// TLS : client TLS of a backend. CAFile replaces the system roots, the
+// client certificate is sent when CertFile and KeyFile are set
+type TLS struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// ClientConfig : TLS configuration loading the files, nil when TLS is
+// disabled
+func (t TLS) ClientConfig() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Zone : a zone served by the instance with its ACL overrides
+type Zone struct {
+	Name string `yaml:"name"`
+	ACL  ACL    `yaml:"acl"`
+}
+
+// ACL : entries for each operation as "CIDR", "!CIDR" or "key:name."
+// A nil list is not set and inherits the global one
+type ACL struct {
+	Query    []string `yaml:"query"`
+	Transfer []string `yaml:"transfer"`
+	Update   []string `yaml:"update"`
+	Notify   []string `yaml:"notify"`
+}
+
+// TSIGKey : TSIG key name and base64 secret
+type TSIGKey struct {
+	Name   string `yaml:"name"`
+	Secret string `yaml:"secret"`
+}
+
+// Logging : query logging options
+type Logging struct {
+	Print  bool   `yaml:"print"`
+	Dnstap Dnstap `yaml:"dnstap"`
+}
+
+// Dnstap : dnstap output, disabled when Target is empty
+type Dnstap struct {
+	Target string `yaml:"target"`
+	Sample int    `yaml:"sample"`
+	Buffer int    `yaml:"buffer"`
+}
+
+// RRL : response rate limiting, disabled when ResponsesPerSecond is 0.
+// A client prefix gets ResponsesPerSecond responses of each type a
+// second, Window is the seconds of excess responses it owes at most
+type RRL struct {
+	ResponsesPerSecond int      `yaml:"responsesPerSecond"`
+	Window             int      `yaml:"window"`
+	Slip               int      `yaml:"slip"`
+	IPv4PrefixLen      int      `yaml:"ipv4PrefixLen"`
+	IPv6PrefixLen      int      `yaml:"ipv6PrefixLen"`
+	Exempt             []string `yaml:"exempt"`
+}
+
+// Health : HTTP health and readiness endpoints, disabled when Listen is empty
+type Health struct {
+	Listen string `yaml:"listen"`
+	// Readiness fails when pinging the database takes longer
+	LatencyBudget time.Duration `yaml:"latencyBudget"`
+}
+
+// Cache : RRset cache in front of the backend, disabled when MaxBytes is 0
+type Cache struct {
+	MaxBytes int64         `yaml:"maxBytes"`
+	MaxTTL   time.Duration `yaml:"maxTTL"`
+	// TTL of negative answers outside of the configured zones
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
+	Shards      int           `yaml:"shards"`
+	// How long expired records are served when the backend fails, 0 disables
+	StaleWindow time.Duration `yaml:"staleWindow"`
+	StaleTTL    time.Duration `yaml:"staleTTL"`
+	StaleRetry  time.Duration `yaml:"staleRetry"`
+}
+
+// ZoneNames : names of the configured zones
+func (c *Config) ZoneNames() []string {
+	names := make([]string, len(c.Zones))
+	for i, zone := range c.Zones {
+		names[i] = zone.Name
+	}
+	return names
+}
+
+// Default : configuration used when no file is given
+func Default() *Config {
+	return &Config{
+		Listen: Listen{Port: 8053, ShutdownTimeout: 5 * time.Second},
+		Backend: Backend{
+			DB:           "cassandra",
+			ClusterIPs:   []string{"192.168.0.240", "192.168.0.241", "192.168.0.242"},
+			QueryTimeout: time.Second,
+			Cassandra: Cassandra{
+				Keyspace:       "dns",
+				Consistency:    "quorum",
+				Timeout:        600 * time.Millisecond,
+				ConnectTimeout: 600 * time.Millisecond,
+				NumConns:       2,
+
+				WriteAttempts:       5,
+				ReadRetries:         1,
+				MinBackoff:          100 * time.Millisecond,
+				MaxBackoff:          2 * time.Second,
+				SpeculativeAttempts: 1,
+				SpeculativeDelay:    200 * time.Millisecond,
+				BatchSize:           100,
+				BatchConcurrency:    8,
+
+				Replication: Replication{Class: "SimpleStrategy", Factor: 3},
+				Model:       "records",
+			},
+			Redis: Redis{Model: "keys", PipelineSize: 1000, Mode: "cluster"},
+			Etcd: Etcd{
+				Timeout:     10 * time.Second, // Generous times for stressfull scenarios
+				DialTimeout: 5 * time.Second,
+				// etcd server defaults
+				MaxTxnOps:       128,
+				MaxRequestBytes: 1536 * 1024,
+				WriteAttempts:   10,
+				MinBackoff:      10 * time.Millisecond,
+				MaxBackoff:      time.Second,
+			},
+		},
+		Logging: Logging{Dnstap: Dnstap{Sample: 1, Buffer: 4096}},
+		RRL:     RRL{Window: 15, Slip: 2, IPv4PrefixLen: 24, IPv6PrefixLen: 56},
+		Health:  Health{LatencyBudget: 500 * time.Millisecond},
+		Cache: Cache{MaxTTL: time.Hour, NegativeTTL: time.Minute, Shards: 64,
+			StaleTTL: 30 * time.Second, StaleRetry: 30 * time.Second},
+	}
+}
+
+// Load : reads the YAML file at path on top of the defaults and
+// validates it. Unknown keys are errors.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := Default()
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate : checks every value of the configuration
+func (c *Config) Validate() error {
+	if c.Listen.Port < 1 || c.Listen.Port > 65535 {
+		return fmt.Errorf("listen.port %d out of range", c.Listen.Port)
+	}
+	if c.Listen.ReusePort < 0 || c.Listen.CPU < 0 {
+		return fmt.Errorf("listen.reuseport and listen.cpu can't be negative")
+	}
+	if c.Listen.ShutdownTimeout <= 0 {
+		return fmt.Errorf("listen.shutdownTimeout must be positive")
+	}
+
+	if err := c.Backend.validate(); err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool)
+	for i, key := range c.TSIG {
+		if _, ok := dns.IsDomainName(key.Name); !ok || key.Name == "" {
+			return fmt.Errorf("tsig[%d].name %q is not a domain name", i, key.Name)
+		}
+		if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil {
+			return fmt.Errorf("tsig %s: secret is not base64: %v", key.Name, err)
+		}
+		keys[dns.CanonicalName(key.Name)] = true
+	}
+
+	if err := c.ACL.validate("acl", keys); err != nil {
+		return err
+	}
+	if c.Backend.DB == "cassandra" && c.Backend.Cassandra.Model == "zones" && len(c.Zones) == 0 {
+		return fmt.Errorf("backend.cassandra.model zones needs the zones to be configured")
+	}
+	if c.Backend.DB == "redis" && c.Backend.Redis.Model == "hashes" && len(c.Zones) == 0 {
+		return fmt.Errorf("backend.redis.model hashes needs the zones to be configured")
+	}
+	zones := make(map[string]bool)
+	for i, zone := range c.Zones {
+		if _, ok := dns.IsDomainName(zone.Name); !ok || zone.Name == "" {
+			return fmt.Errorf("zones[%d].name %q is not a domain name", i, zone.Name)
+		}
+		name := dns.CanonicalName(zone.Name)
+		if zones[name] {
+			return fmt.Errorf("zone %s defined twice", name)
+		}
+		zones[name] = true
+		if err := zone.ACL.validate("zones["+name+"].acl", keys); err != nil {
+			return err
+		}
+	}
+
+	if c.Logging.Dnstap.Sample < 0 || c.Logging.Dnstap.Buffer < 0 {
+		return fmt.Errorf("logging.dnstap sample and buffer can't be negative")
+	}
+
+	if err := c.RRL.validate(); err != nil {
+		return err
+	}
+
+	if c.Cache.MaxBytes < 0 {
+		return fmt.Errorf("cache.maxBytes can't be negative")
+	}
+	if c.Cache.MaxBytes > 0 && (c.Cache.MaxTTL <= 0 || c.Cache.NegativeTTL < 0 || c.Cache.Shards <= 0) {
+		return fmt.Errorf("cache maxTTL and shards must be positive and negativeTTL not negative")
+	}
+	if c.Cache.StaleWindow < 0 {
+		return fmt.Errorf("cache.staleWindow can't be negative")
+	}
+	if c.Cache.StaleWindow > 0 && (c.Cache.StaleTTL <= 0 || c.Cache.StaleRetry <= 0) {
+		return fmt.Errorf("cache staleTTL and staleRetry must be positive")
+	}
+
+	if c.Health.LatencyBudget <= 0 {
+		return fmt.Errorf("health.latencyBudget must be positive")
+	}
+	if c.Health.Listen != "" && c.Health.Listen == c.Metrics {
+		return fmt.Errorf("health.listen and metrics must use different addresses")
+	}
+	return nil
+}
+
+// cqlIdentifier : valid unquoted keyspace name
+var cqlIdentifier = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`)
+
+// dataCenterName : datacenter names accepted in the replication options
+var dataCenterName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func (r *Replication) validate() error {
+	switch r.Class {
+	case "SimpleStrategy":
+		if r.Factor <= 0 {
+			return fmt.Errorf("backend.cassandra.replication.factor must be positive")
+		}
+	case "NetworkTopologyStrategy":
+		if len(r.DataCenters) == 0 {
+			return fmt.Errorf("backend.cassandra.replication.dataCenters is empty")
+		}
+		for dc, factor := range r.DataCenters {
+			if !dataCenterName.MatchString(dc) || factor <= 0 {
+				return fmt.Errorf("backend.cassandra.replication.dataCenters: bad entry %q: %d", dc, factor)
+			}
+		}
+	default:
+		return fmt.Errorf("backend.cassandra.replication.class %q must be SimpleStrategy or NetworkTopologyStrategy", r.Class)
+	}
+	return nil
+}
+
+func (b *Backend) validate() error {
+	switch b.DB {
+	case "cassandra", "redis", "etcd":
+	default:
+		return fmt.Errorf("backend.db %q must be one of cassandra, redis or etcd", b.DB)
+	}
+	if len(b.ClusterIPs) == 0 {
+		return fmt.Errorf("backend.clusterIPs is empty")
+	}
+	if b.QueryTimeout <= 0 {
+		return fmt.Errorf("backend.queryTimeout must be positive")
+	}
+	for _, ip := range b.ClusterIPs {
+		if strings.TrimSpace(ip) == "" {
+			return fmt.Errorf("backend.clusterIPs has an empty address")
+		}
+	}
+
+	if !cqlIdentifier.MatchString(b.Cassandra.Keyspace) {
+		return fmt.Errorf("backend.cassandra.keyspace %q must be up to 48 letters, digits or underscores", b.Cassandra.Keyspace)
+	}
+	if err := b.Cassandra.Replication.validate(); err != nil {
+		return err
+	}
+	if b.Cassandra.Model != "records" && b.Cassandra.Model != "zones" {
+		return fmt.Errorf("backend.cassandra.model %q must be records or zones", b.Cassandra.Model)
+	}
+	// Unset read and write consistencies take the general one
+	if b.Cassandra.ReadConsistency == "" {
+		b.Cassandra.ReadConsistency = b.Cassandra.Consistency
+	}
+	if b.Cassandra.WriteConsistency == "" {
+		b.Cassandra.WriteConsistency = b.Cassandra.Consistency
+	}
+	for name, consistency := range map[string]string{"consistency": b.Cassandra.Consistency,
+		"readConsistency": b.Cassandra.ReadConsistency, "writeConsistency": b.Cassandra.WriteConsistency} {
+		if _, err := gocql.ParseConsistencyWrapper(consistency); err != nil {
+			return fmt.Errorf("backend.cassandra.%s: %v", name, err)
+		}
+	}
+	if b.Cassandra.Timeout < 0 || b.Cassandra.ConnectTimeout < 0 || b.Cassandra.NumConns < 0 {
+		return fmt.Errorf("backend.cassandra timeouts and numConns can't be negative")
+	}
+	if b.Cassandra.WriteAttempts < 1 || b.Cassandra.ReadRetries < 0 || b.Cassandra.SpeculativeAttempts < 0 {
+		return fmt.Errorf("backend.cassandra writeAttempts must be positive, readRetries and speculativeAttempts not negative")
+	}
+	if b.Cassandra.MinBackoff <= 0 || b.Cassandra.MaxBackoff < b.Cassandra.MinBackoff {
+		return fmt.Errorf("backend.cassandra minBackoff must be positive and not over maxBackoff")
+	}
+	if b.Cassandra.SpeculativeAttempts > 0 && b.Cassandra.SpeculativeDelay <= 0 {
+		return fmt.Errorf("backend.cassandra.speculativeDelay must be positive")
+	}
+	if b.Cassandra.BatchSize <= 0 || b.Cassandra.BatchConcurrency <= 0 {
+		return fmt.Errorf("backend.cassandra batchSize and batchConcurrency must be positive")
+	}
+
+	if b.Redis.PoolSize < 0 || b.Redis.MaxRedirects < 0 || b.Redis.PipelineSize < 0 ||
+		b.Redis.DialTimeout < 0 || b.Redis.ReadTimeout < 0 || b.Redis.WriteTimeout < 0 {
+		return fmt.Errorf("backend.redis options can't be negative")
+	}
+	if b.Redis.Model != "keys" && b.Redis.Model != "hashes" {
+		return fmt.Errorf("backend.redis.model %q must be keys or hashes", b.Redis.Model)
+	}
+	switch b.Redis.Mode {
+	case "cluster", "standalone":
+	case "sentinel":
+		if b.Redis.MasterName == "" {
+			return fmt.Errorf("backend.redis.masterName is needed in sentinel mode")
+		}
+	default:
+		return fmt.Errorf("backend.redis.mode %q must be cluster, sentinel or standalone", b.Redis.Mode)
+	}
+
+	if b.Etcd.Timeout <= 0 || b.Etcd.DialTimeout <= 0 {
+		return fmt.Errorf("backend.etcd timeout and dialTimeout must be positive")
+	}
+	if b.Etcd.MaxTxnOps < 0 || b.Etcd.MaxRequestBytes < 0 {
+		return fmt.Errorf("backend.etcd maxTxnOps and maxRequestBytes can't be negative")
+	}
+	if b.Etcd.WriteAttempts < 1 {
+		return fmt.Errorf("backend.etcd.writeAttempts must be at least 1")
+	}
+	if b.Etcd.MinBackoff <= 0 || b.Etcd.MaxBackoff < b.Etcd.MinBackoff {
+		return fmt.Errorf("backend.etcd minBackoff must be positive and not above maxBackoff")
+	}
+
+	// Only the secrets and certificates of the backend in use are loaded
+	auth, tlsOpts := b.Security()
+	if err := auth.validate(); err != nil {
+		return fmt.Errorf("backend.%s.auth: %v", b.DB, err)
+	}
+	if _, err := tlsOpts.ClientConfig(); err != nil {
+		return fmt.Errorf("backend.%s.tls: %v", b.DB, err)
+	}
+	// gocql verifies every node against the same name
+	if b.DB == "cassandra" && tlsOpts.Enabled && !tlsOpts.InsecureSkipVerify && tlsOpts.ServerName == "" {
+		return fmt.Errorf("backend.cassandra.tls.serverName is needed to verify the nodes")
+	}
+	return nil
+}
+
+// Security : credentials and TLS options of the selected backend
+func (b *Backend) Security() (Auth, TLS) {
+	switch b.DB {
+	case "redis":
+		return b.Redis.Auth, b.Redis.TLS
+	case "etcd":
+		return b.Etcd.Auth, b.Etcd.TLS
+	default:
+		return b.Cassandra.Auth, b.Cassandra.TLS
+	}
+}
+
+// validate checks every entry, the key names against the defined TSIG
+// keys
+func (a *ACL) validate(path string, keys map[string]bool) error {
+	lists := map[string][]string{
+		"query":    a.Query,
+		"transfer": a.Transfer,
+		"update":   a.Update,
+		"notify":   a.Notify,
+	}
+	for op, entries := range lists {
+		for _, entry := range entries {
+			if err := validateACLEntry(entry, keys); err != nil {
+				return fmt.Errorf("%s.%s: %v", path, op, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateACLEntry(entry string, keys map[string]bool) error {
+	entry = strings.TrimSpace(entry)
+	switch {
+	case strings.HasPrefix(entry, "key:"):
+		name := strings.TrimPrefix(entry, "key:")
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("invalid key name in %q", entry)
+		}
+		if !keys[dns.CanonicalName(name)] {
+			return fmt.Errorf("key %s in %q is not defined in tsig", name, entry)
+		}
+		return nil
+	case strings.HasPrefix(entry, "!"):
+		entry = strings.TrimPrefix(entry, "!")
+	}
+	if strings.Contains(entry, "/") {
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return err
+		}
+		return nil
+	}
+	if net.ParseIP(entry) == nil {
+		return fmt.Errorf("invalid address %q", entry)
+	}
+	return nil
+}
+
+func (r *RRL) validate() error {
+	if r.ResponsesPerSecond < 0 || r.Window < 0 || r.Slip < 0 {
+		return fmt.Errorf("rrl responsesPerSecond, window and slip can't be negative")
+	}
+	if r.ResponsesPerSecond > 0 && r.Window == 0 {
+		return fmt.Errorf("rrl.window must be positive when rate limiting")
+	}
+	if r.IPv4PrefixLen < 0 || r.IPv4PrefixLen > 32 {
+		return fmt.Errorf("rrl.ipv4PrefixLen %d out of range", r.IPv4PrefixLen)
+	}
+	if r.IPv6PrefixLen < 0 || r.IPv6PrefixLen > 128 {
+		return fmt.Errorf("rrl.ipv6PrefixLen %d out of range", r.IPv6PrefixLen)
+	}
+	for _, cidr := range r.Exempt {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("rrl.exempt: %v", err)
+		}
+	}
+	return nil
+}
+
+// FromFlags : loads the file at path, or the defaults when path is "",
+// and applies the flags explicitly set on fs. This is the loader shared
+// by every binary of the repository.
+func FromFlags(path string, fs *flag.FlagSet) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		var err error
+		cfg, err = Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyFlags(fs); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ApplyFlags : overrides the configuration with the command line flags
+// that were explicitly set and validates the result. Flags that are not
+// part of the configuration are ignored.
+func (c *Config) ApplyFlags(fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = c.set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return c.Validate()
+}
+
+func (c *Config) set(name, value string) error {
+	var err error
+	switch name {
+	case "port":
+		c.Listen.Port, err = strconv.Atoi(value)
+	case "soreuseport":
+		c.Listen.ReusePort, err = strconv.Atoi(value)
+	case "cpu":
+		c.Listen.CPU, err = strconv.Atoi(value)
+	case "db":
+		c.Backend.DB = value
+	case "clusterIPs":
+		c.Backend.ClusterIPs = splitList(value)
+	case "queryTimeout":
+		c.Backend.QueryTimeout, err = time.ParseDuration(value)
+	case "print":
+		c.Logging.Print, err = strconv.ParseBool(value)
+	case "dnstap":
+		c.Logging.Dnstap.Target = value
+	case "dnstapSample":
+		c.Logging.Dnstap.Sample, err = strconv.Atoi(value)
+	case "dnstapBuffer":
+		c.Logging.Dnstap.Buffer, err = strconv.Atoi(value)
+	case "rrl":
+		c.RRL.ResponsesPerSecond, err = strconv.Atoi(value)
+	case "rrlWindow":
+		c.RRL.Window, err = strconv.Atoi(value)
+	case "rrlSlip":
+		c.RRL.Slip, err = strconv.Atoi(value)
+	case "rrlExempt":
+		c.RRL.Exempt = splitList(value)
+	case "metrics":
+		c.Metrics = value
+	case "health":
+		c.Health.Listen = value
+	case "cache":
+		c.Cache.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+	}
+	if err != nil {
+		return fmt.Errorf("flag --%s: %v", name, err)
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag value dropping empty items
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dario617/goKvsDns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// Operations with their own access list
+const (
+	OpQuery    = "query"
+	OpTransfer = "transfer"
+	OpUpdate   = "update"
+	OpNotify   = "notify"
+)
+
+// ACL : allow and deny lists for one operation. Deny entries win over
+// allow entries, an empty allow list allows everyone not denied and
+// if Keys is not empty the request must be signed with one of them
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+	Keys  []string
+}
+
+// ParseACL : reads an ACL from a comma separated list of entries where
+// "10.0.0.0/8" allows a network, "!10.1.0.0/16" denies it and
+// "key:name." requires the TSIG key name. Single addresses are taken
+// as host networks.
+func ParseACL(spec string) (*ACL, error) {
+	acl := new(ACL)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.HasPrefix(entry, "key:"):
+			acl.Keys = append(acl.Keys, dns.Fqdn(strings.ToLower(strings.TrimPrefix(entry, "key:"))))
+		case strings.HasPrefix(entry, "!"):
+			network, err := parseNetwork(strings.TrimPrefix(entry, "!"))
+			if err != nil {
+				return nil, err
+			}
+			acl.Deny = append(acl.Deny, network)
+		default:
+			network, err := parseNetwork(entry)
+			if err != nil {
+				return nil, err
+			}
+			acl.Allow = append(acl.Allow, network)
+		}
+	}
+	return acl, nil
+}
+
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %s: %v", s, err)
+	}
+	return network, nil
+}
+
+// permits checks the client address and verified TSIG key against the list
+func (acl *ACL) permits(ip net.IP, tsig *dns.TSIG) bool {
+	for _, network := range acl.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.Allow) > 0 {
+		allowed := false
+		for _, network := range acl.Allow {
+			if network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(acl.Keys) > 0 {
+		if tsig == nil {
+			return false
+		}
+		name := strings.ToLower(tsig.Hdr.Name)
+		for _, key := range acl.Keys {
+			if key == name {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// AccessControl : global ACLs for each operation that can be
+// overridden per zone, plus the TSIG secrets known to the server
+type AccessControl struct {
+	Global map[string]*ACL
+	Zones  map[string]map[string]*ACL
+	// TSIG secrets in base64 by key name
+	Keys map[string]string
+}
+
+// NewAccessControl : empty access control, allowing everything
+func NewAccessControl() *AccessControl {
+	return &AccessControl{
+		Global: make(map[string]*ACL),
+		Zones:  make(map[string]map[string]*ACL),
+		Keys:   make(map[string]string),
+	}
+}
+
+// Set : assigns the ACL of an operation, globally when zone is ""
+func (ac *AccessControl) Set(zone, op string, acl *ACL) error {
+	switch op {
+	case OpQuery, OpTransfer, OpUpdate, OpNotify:
+	default:
+		return fmt.Errorf("unknown ACL operation %s", op)
+	}
+	if zone == "" {
+		ac.Global[op] = acl
+		return nil
+	}
+	zone = dns.CanonicalName(zone)
+	if ac.Zones[zone] == nil {
+		ac.Zones[zone] = make(map[string]*ACL)
+	}
+	ac.Zones[zone][op] = acl
+	return nil
+}
+
+// accessControlFromConfig builds the global and per zone ACLs with the
+// TSIG keys. Returns nil when nothing is configured
+func accessControlFromConfig(cfg *config.Config) (*AccessControl, error) {
+	ac := NewAccessControl()
+	empty := len(cfg.TSIG) == 0
+	for _, key := range cfg.TSIG {
+		ac.AddKey(key.Name, key.Secret)
+	}
+	set := func(zone string, acl config.ACL) error {
+		lists := map[string][]string{
+			OpQuery:    acl.Query,
+			OpTransfer: acl.Transfer,
+			OpUpdate:   acl.Update,
+			OpNotify:   acl.Notify,
+		}
+		for op, entries := range lists {
+			if entries == nil {
+				continue
+			}
+			parsed, err := ParseACL(strings.Join(entries, ","))
+			if err != nil {
+				return err
+			}
+			if err := ac.Set(zone, op, parsed); err != nil {
+				return err
+			}
+			empty = false
+		}
+		return nil
+	}
+	if err := set("", cfg.ACL); err != nil {
+		return nil, err
+	}
+	for _, zone := range cfg.Zones {
+		if err := set(zone.Name, zone.ACL); err != nil {
+			return nil, err
+		}
+	}
+	if empty {
+		return nil, nil
+	}
+	return ac, nil
+}
+
+// AddKey : registers a TSIG secret in base64 for the key name
+func (ac *AccessControl) AddKey(name, secret string) {
+	ac.Keys[dns.CanonicalName(name)] = secret
+}
+
+// lookup finds the ACL for op on the most specific zone containing name
+func (ac *AccessControl) lookup(name, op string) *ACL {
+	name = dns.CanonicalName(name)
+	best := -1
+	var acl *ACL
+	for zone, acls := range ac.Zones {
+		zoneACL, ok := acls[op]
+		if !ok || !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		if labels := dns.CountLabel(zone); labels > best {
+			best = labels
+			acl = zoneACL
+		}
+	}
+	if acl != nil {
+		return acl
+	}
+	return ac.Global[op]
+}
+
+// allowed tells if the request may be served
+func (ac *AccessControl) allowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(r.Question) == 0 {
+		return true
+	}
+	acl := ac.lookup(r.Question[0].Name, operation(r))
+	if acl == nil {
+		return true
+	}
+	var ip net.IP
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	return acl.permits(ip, ac.verified(w, r))
+}
+
+// verified returns the TSIG record of the request when it was signed
+// with a known key and the signature checked out
+func (ac *AccessControl) verified(w dns.ResponseWriter, r *dns.Msg) *dns.TSIG {
+	tsig := r.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		return nil
+	}
+	if _, ok := ac.Keys[dns.CanonicalName(tsig.Hdr.Name)]; !ok {
+		return nil
+	}
+	return tsig
+}
+
+// operation classifies a request by opcode and question type
+func operation(r *dns.Msg) string {
+	switch r.Opcode {
+	case dns.OpcodeUpdate:
+		return OpUpdate
+	case dns.OpcodeNotify:
+		return OpNotify
+	}
+	if len(r.Question) > 0 {
+		switch r.Question[0].Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR:
+			return OpTransfer
+		}
+	}
+	return OpQuery
+}
@@ -0,0 +1,431 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache : sharded in memory RRset cache with LRU eviction. Entries are
+// keyed by owner name and type and hold the answer and rcode given by
+// the driver. Expired entries are kept for StaleWindow to answer with
+// them when the backend fails (RFC 8767).
+type Cache struct {
+	shards   []*cacheShard
+	maxTTL   time.Duration
+	maxBytes int64
+
+	StaleWindow time.Duration
+	// TTL given to the records of stale answers
+	StaleTTL uint32
+}
+
+type cacheShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	limit   int64
+}
+
+// cacheEntry : answer for a name and type until expires
+type cacheEntry struct {
+	key     string
+	answer  []dns.RR
+	rcode   int
+	stored  time.Time
+	expires time.Time
+	size    int64
+}
+
+// Fixed cost accounted for every entry besides its records
+const cacheEntryOverhead = 128
+
+// NewCache : cache of at most maxBytes split in shards. TTLs longer than
+// maxTTL are capped
+func NewCache(maxBytes int64, maxTTL time.Duration, shards int) *Cache {
+	if shards <= 0 {
+		shards = 1
+	}
+	c := &Cache{
+		shards:   make([]*cacheShard, shards),
+		maxTTL:   maxTTL,
+		maxBytes: maxBytes,
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+			limit:   maxBytes / int64(shards),
+		}
+	}
+	return c
+}
+
+func cacheKey(name string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + ":" + dns.TypeToString[qtype]
+}
+
+func (c *Cache) shard(key string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// Get : answer and rcode cached for name and type. The records are
+// copies with their TTL decreased by the time spent in the cache
+func (c *Cache) Get(name string, qtype uint16) ([]dns.RR, int, bool) {
+	key := cacheKey(name, qtype)
+	s := c.shard(key)
+	now := time.Now()
+
+	s.mu.Lock()
+	elem, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		cacheMisses.Add(1)
+		return nil, 0, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if now.After(e.expires) {
+		if now.After(e.expires.Add(c.StaleWindow)) {
+			s.remove(elem)
+		}
+		s.mu.Unlock()
+		cacheMisses.Add(1)
+		return nil, 0, false
+	}
+	s.lru.MoveToFront(elem)
+	s.mu.Unlock()
+
+	cacheHits.Add(1)
+	return e.copyAnswer(now), e.rcode, true
+}
+
+// GetStale : answer and rcode cached for name and type, even if expired
+// as long as it is within the stale window. Expired records get StaleTTL
+func (c *Cache) GetStale(name string, qtype uint16) ([]dns.RR, int, bool) {
+	key := cacheKey(name, qtype)
+	s := c.shard(key)
+	now := time.Now()
+
+	s.mu.Lock()
+	elem, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, 0, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if now.After(e.expires.Add(c.StaleWindow)) {
+		s.remove(elem)
+		s.mu.Unlock()
+		return nil, 0, false
+	}
+	s.lru.MoveToFront(elem)
+	s.mu.Unlock()
+
+	answer := e.copyAnswer(now)
+	if now.After(e.expires) {
+		for _, rr := range answer {
+			rr.Header().Ttl = c.StaleTTL
+		}
+	}
+	return answer, e.rcode, true
+}
+
+// Set : stores the answer for ttl, capped to the maximum TTL
+func (c *Cache) Set(name string, qtype uint16, answer []dns.RR, rcode int, ttl time.Duration) {
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	key := cacheKey(name, qtype)
+	now := time.Now()
+	e := &cacheEntry{
+		key:     key,
+		answer:  make([]dns.RR, len(answer)),
+		rcode:   rcode,
+		stored:  now,
+		expires: now.Add(ttl),
+		size:    cacheEntryOverhead + int64(len(key)),
+	}
+	for i, rr := range answer {
+		e.answer[i] = dns.Copy(rr)
+		e.size += int64(dns.Len(rr))
+	}
+
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.size > s.limit {
+		return
+	}
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	s.entries[key] = s.lru.PushFront(e)
+	s.bytes += e.size
+	for s.bytes > s.limit {
+		s.remove(s.lru.Back())
+		cacheEvictions.Add(1)
+	}
+}
+
+// Evict : removes the entry of name and type
+func (c *Cache) Evict(name string, qtype uint16) {
+	key := cacheKey(name, qtype)
+	s := c.shard(key)
+	s.mu.Lock()
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	s.mu.Unlock()
+}
+
+// EvictKey : removes the entry of a backend key in the name:TYPE form,
+// keys of unknown types are ignored
+func (c *Cache) EvictKey(key string) {
+	i := strings.LastIndex(key, ":")
+	if i < 0 {
+		return
+	}
+	if qtype, ok := dns.StringToType[key[i+1:]]; ok {
+		c.Evict(key[:i], qtype)
+	}
+}
+
+// EvictName : removes the entries of every type of name
+func (c *Cache) EvictName(name string) {
+	for qtype := range dns.TypeToString {
+		c.Evict(name, qtype)
+	}
+}
+
+// Expire : marks every entry as expired, keeping them as stale answers
+func (c *Cache) Expire() {
+	now := time.Now()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+			if e := elem.Value.(*cacheEntry); e.expires.After(now) {
+				e.expires = now
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Flush : removes every entry
+func (c *Cache) Flush() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.entries = make(map[string]*list.Element)
+		s.lru.Init()
+		s.bytes = 0
+		s.mu.Unlock()
+	}
+}
+
+// remove must be called holding the shard lock
+func (s *cacheShard) remove(elem *list.Element) {
+	e := s.lru.Remove(elem).(*cacheEntry)
+	delete(s.entries, e.key)
+	s.bytes -= e.size
+}
+
+func (e *cacheEntry) copyAnswer(now time.Time) []dns.RR {
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	answer := make([]dns.RR, len(e.answer))
+	for i, rr := range e.answer {
+		answer[i] = dns.Copy(rr)
+		if hdr := answer[i].Header(); hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+	}
+	return answer
+}
+
+// Invalidator : drivers able to report changes made on the backend.
+// WatchChanges evicts the changed RRsets from cache until ctx is done,
+// expiring it whenever changes could have been missed
+type Invalidator interface {
+	WatchChanges(ctx context.Context, cache *Cache)
+}
+
+// CachedDriver : DBDriver answering from a Cache before asking the
+// wrapped driver. Negative answers are kept for the SOA minimum of the
+// closest configured zone, or NegativeTTL when no zone is known.
+// When the driver fails stale entries are served while the RRset is
+// retried in the background every StaleRetry.
+type CachedDriver struct {
+	DBDriver
+	Cache       *Cache
+	NegativeTTL time.Duration
+	StaleRetry  time.Duration
+	zones       atomic.Value // []string
+
+	// RRsets being retried, answered stale without asking the driver
+	retrying sync.Map
+}
+
+// NewCachedDriver : wraps driver with cache, zones are the configured
+// zone names used to find the SOA of negative answers
+func NewCachedDriver(driver DBDriver, cache *Cache, zones []string, negativeTTL time.Duration) *CachedDriver {
+	c := &CachedDriver{DBDriver: driver, Cache: cache, NegativeTTL: negativeTTL}
+	c.SetZones(zones)
+	return c
+}
+
+// SetZones : replaces the configured zone names, also on the wrapped
+// driver when it uses them
+func (c *CachedDriver) SetZones(zones []string) {
+	c.zones.Store(zones)
+	if driver, ok := c.DBDriver.(ZoneAware); ok {
+		driver.SetZones(zones)
+	}
+}
+
+// MakeQuery : answers from the cache or asks the driver and caches the
+// result. Server failures are never cached, a stale answer is given
+// instead when there is one, returning an error wrapping ErrStale
+func (c *CachedDriver) MakeQuery(ctx context.Context, m *dns.Msg) error {
+	q := m.Question[0]
+	if answer, rcode, ok := c.Cache.Get(q.Name, q.Qtype); ok {
+		m.Answer = append(m.Answer, answer...)
+		return rcodeError(rcode)
+	}
+
+	key := cacheKey(q.Name, q.Qtype)
+	if _, ok := c.retrying.Load(key); ok {
+		if rcode, ok := c.serveStale(m); ok {
+			return &staleAnswer{rcode: rcode}
+		}
+	}
+
+	err := c.lookup(ctx, m)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if rcode, ok := c.serveStale(m); ok {
+		if _, loaded := c.retrying.LoadOrStore(key, struct{}{}); !loaded {
+			go c.retry(key, q)
+		}
+		return &staleAnswer{rcode: rcode, cause: err}
+	}
+	return err
+}
+
+// lookup asks the driver for the RRset of the question, caching the
+// result. Concurrent misses of an RRset share a single driver query when
+// the driver is a CoalescedDriver
+func (c *CachedDriver) lookup(ctx context.Context, m *dns.Msg) error {
+	query := new(dns.Msg)
+	query.SetQuestion(m.Question[0].Name, m.Question[0].Qtype)
+	err := c.DBDriver.MakeQuery(ctx, query)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		c.store(ctx, query, errorRcode(err))
+	}
+	m.Answer = append(m.Answer, query.Answer...)
+	return err
+}
+
+// serveStale answers m from an expired entry, returning the rcode it was
+// cached with
+func (c *CachedDriver) serveStale(m *dns.Msg) (int, bool) {
+	q := m.Question[0]
+	answer, rcode, ok := c.Cache.GetStale(q.Name, q.Qtype)
+	if !ok {
+		return 0, false
+	}
+	m.Answer = append(m.Answer[:0], answer...)
+	cacheStale.Add(1)
+	return rcode, true
+}
+
+// retry asks the driver for the RRset until it answers or the stale
+// entry is gone
+func (c *CachedDriver) retry(key string, q dns.Question) {
+	defer c.retrying.Delete(key)
+	for {
+		time.Sleep(c.StaleRetry)
+		m := new(dns.Msg)
+		m.SetQuestion(q.Name, q.Qtype)
+		ctx, cancel := context.WithTimeout(context.Background(), c.StaleRetry)
+		err := c.lookup(ctx, m)
+		cancel()
+		if err == nil || errors.Is(err, ErrNotFound) {
+			return
+		}
+		if _, _, ok := c.Cache.GetStale(q.Name, q.Qtype); !ok {
+			return
+		}
+	}
+}
+
+// store caches the answer given by the driver
+func (c *CachedDriver) store(ctx context.Context, m *dns.Msg, rcode int) {
+	q := m.Question[0]
+	switch {
+	case len(m.Answer) > 0:
+		c.Cache.Set(q.Name, q.Qtype, m.Answer, rcode, minTTL(m.Answer))
+	default:
+		c.Cache.Set(q.Name, q.Qtype, nil, rcode, c.negativeTTL(ctx, q))
+	}
+}
+
+// negativeTTL : minimum of the SOA TTL and MINIMUM field of the zone
+// containing the question
+func (c *CachedDriver) negativeTTL(ctx context.Context, q dns.Question) time.Duration {
+	zone := closestZone(c.zones.Load().([]string), q.Name)
+	if zone == "" || (q.Qtype == dns.TypeSOA && dns.CanonicalName(q.Name) == zone) {
+		return c.NegativeTTL
+	}
+	soaMsg := new(dns.Msg)
+	soaMsg.SetQuestion(zone, dns.TypeSOA)
+	if c.MakeQuery(ctx, soaMsg) != nil {
+		return c.NegativeTTL
+	}
+	for _, rr := range soaMsg.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return c.NegativeTTL
+}
+
+// closestZone : most specific zone of the list containing name, "" if none
+func closestZone(zones []string, name string) string {
+	best := ""
+	for _, zone := range zones {
+		zone = dns.CanonicalName(zone)
+		if dns.IsSubDomain(zone, name) && dns.CountLabel(zone) >= dns.CountLabel(best) {
+			best = zone
+		}
+	}
+	return best
+}
+
+func minTTL(rrs []dns.RR) time.Duration {
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
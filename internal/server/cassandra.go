@@ -1,330 +1,423 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
-	"net"
-	"strings"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/dario617/goKvsDns/internal/utils"
 	"github.com/gocql/gocql"
 	"github.com/miekg/dns"
 )
 
+// Statements used by the driver. gocql prepares the statements with bind
+// markers on each connection the first time they are used and keeps them
+// cached, and routes them to a replica of the partition with the token
+// aware policy
+const (
+	selectRRsetCQL    = `SELECT rrset FROM domain_records WHERE domain_name = ? AND type = ?`
+	insertRecordCQL   = `INSERT INTO domain_records (domain_name, type, rdata, rrset) VALUES (?, ?, ?, ?)`
+	deleteRRsetAtCQL  = `DELETE FROM domain_records USING TIMESTAMP ? WHERE domain_name = ? AND type = ?`
+	insertRecordAtCQL = `INSERT INTO domain_records (domain_name, type, rdata, rrset) VALUES (?, ?, ?, ?) USING TIMESTAMP ?`
+
+	selectNameCQL         = `SELECT type, rrset FROM zone_records WHERE zone = ? AND name = ?`
+	insertZoneRecordCQL   = `INSERT INTO zone_records (zone, name, type, rdata, rrset) VALUES (?, ?, ?, ?, ?)`
+	deleteZoneRRsetAtCQL  = `DELETE FROM zone_records USING TIMESTAMP ? WHERE zone = ? AND name = ? AND type = ?`
+	insertZoneRecordAtCQL = `INSERT INTO zone_records (zone, name, type, rdata, rrset) VALUES (?, ?, ?, ?, ?) USING TIMESTAMP ?`
+)
+
+// Data models of the Cassandra driver
+const (
+	// CassandraRecordsModel : a partition of domain_records per name and type
+	CassandraRecordsModel = "records"
+	// CassandraZonesModel : a partition of zone_records per zone, clustered
+	// by name and type, so a single read gets every RRset of a name
+	CassandraZonesModel = "zones"
+)
+
 // CassandraDB : Implements DBDriver and holds the cassandra session
 type CassandraDB struct {
-	session *gocql.Session
-	Print   bool
+	session          *gocql.Session
+	Print            bool
+	Keyspace         string
+	ReadConsistency  gocql.Consistency
+	WriteConsistency gocql.Consistency
+	// Datacenter preferred for the requests, "" for any
+	LocalDC        string
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	NumConns       int
+
+	WriteAttempts       int
+	ReadRetries         int
+	MinBackoff          time.Duration
+	MaxBackoff          time.Duration
+	SpeculativeAttempts int
+	SpeculativeDelay    time.Duration
+
+	// Statements in each batch of UploadBatch and batches running at once
+	BatchSize        int
+	BatchConcurrency int
+
+	// PasswordAuthenticator credentials when Username is set and client
+	// TLS when TLSConfig isn't nil
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+
+	// Create or migrate the schema on ConnectDB
+	AutoMigrate bool
+	// Replication of the keyspace when it is created, see Migrate
+	Replication map[string]string
+	// Data model of the records, CassandraRecordsModel by default
+	Model string
+
+	zones       atomic.Value // []string
+	zonesMu     sync.Mutex
+	readRetry   gocql.RetryPolicy
+	speculative gocql.SpeculativeExecutionPolicy
 }
 
 // MakeQuery : using a valid session stored on CassandraDB makes a get
 // query to the desired database
-func (c *CassandraDB) MakeQuery(m *dns.Msg) int {
+//
+// Every record is a row of domain_records keyed by its data and holding
+// its encoded RRset
+func (c *CassandraDB) MakeQuery(ctx context.Context, m *dns.Msg) error {
+	if c.Model == CassandraZonesModel {
+		return c.queryZone(ctx, m)
+	}
 
 	var dnsq dns.Question = m.Question[0]
 	s := c.session
+	rrtype := dns.TypeToString[dnsq.Qtype]
+
+	var rrset []byte
+	iter := s.Query(selectRRsetCQL, dnsq.Name, rrtype).WithContext(ctx).
+		Consistency(c.ReadConsistency).Idempotent(true).
+		RetryPolicy(c.readRetry).SetSpeculativeExecutionPolicy(c.speculative).Iter()
+	for iter.Scan(&rrset) {
+		rrs, err := DecodeRRSet(dnsq.Name, dnsq.Qtype, rrset)
+		if err != nil {
+			iter.Close()
+			return corrupt("Cassandra", dnsq.Name+":"+rrtype, err)
+		}
+		m.Answer = append(m.Answer, rrs...)
+	}
+	if err := iter.Close(); err != nil {
+		return backendError(ctx, "Cassandra", err)
+	}
 
-	switch dnsq.Qtype {
-	case dns.TypeA:
-		var domainName string
-		var id gocql.UUID
-		var class uint16
-		var ttl uint32
-		var address string
-
-		iter := s.Query(`SELECT * FROM domain_a WHERE domain_name = ?`, dnsq.Name).Iter()
-		for iter.Scan(&domainName, &id, &address, &class, &ttl) {
-			rr := &dns.A{
-				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
-				A:   net.ParseIP(address).To4(),
-			}
-			m.Answer = append(m.Answer, rr)
+	if len(m.Answer) >= 1 {
+		return nil
+	}
+	return ErrNotFound
+}
+
+// UploadRR to Cassandra Cluster from line. Records are keyed by their
+// data so uploading one again overwrites it. SOA and CNAME replace
+// their RRset as they can only have one record
+func (c *CassandraDB) UploadRR(ctx context.Context, line string) error {
+	rr, err := ParseRecord(line)
+	if err != nil {
+		log.Printf("Error parsing %s: %v", line, err)
+		return err
+	}
+	switch rr.Header().Rrtype {
+	case dns.TypeSOA, dns.TypeCNAME:
+		return c.ReplaceRRset(ctx, []dns.RR{rr})
+	}
+	rrset, err := EncodeRRSet([]dns.RR{rr})
+	if err != nil {
+		return err
+	}
+
+	s := c.session
+	rrtype := dns.TypeToString[rr.Header().Rrtype]
+	stmt, args, err := c.insertStatement(rr, rrset, 0)
+	if err != nil {
+		log.Printf("Error uploading %s %s: %v", rrtype, line, err)
+		return err
+	}
+	err = c.write(ctx, func() error {
+		return s.Query(stmt, args...).WithContext(ctx).Consistency(c.WriteConsistency).Exec()
+	})
+	if err != nil {
+		log.Printf("Error uploading %s %s: %v", rrtype, line, err)
+		return err
+	}
+	return nil
+}
+
+// ReplaceRRset : atomically swaps the records of a name and type for
+// rrs, which must share them. The delete and the inserts go in one
+// batch on a single partition, so readers see either RRset. The inserts
+// are written a microsecond after the delete, otherwise the tombstone
+// would win over them
+func (c *CassandraDB) ReplaceRRset(ctx context.Context, rrs []dns.RR) error {
+	if len(rrs) == 0 {
+		return nil
+	}
+	name := rrs[0].Header().Name
+	rrtype := dns.TypeToString[rrs[0].Header().Rrtype]
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+
+	batch := c.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+	batch.SetConsistency(c.WriteConsistency)
+	if err := c.addReplace(batch, rrs, now); err != nil {
+		return err
+	}
+	if err := c.write(ctx, func() error { return c.session.ExecuteBatch(batch) }); err != nil {
+		log.Printf("Error replacing %s %s: %v", name, rrtype, err)
+		return err
+	}
+	return nil
+}
+
+// addReplace adds to batch the delete of the RRset of rrs at timestamp
+// and the inserts of rrs right after it
+func (c *CassandraDB) addReplace(batch *gocql.Batch, rrs []dns.RR, timestamp int64) error {
+	name := rrs[0].Header().Name
+	rrtype := dns.TypeToString[rrs[0].Header().Rrtype]
+	if c.Model == CassandraZonesModel {
+		zone, err := c.zoneOf(name)
+		if err != nil {
+			return err
 		}
-		if err := iter.Close(); err != nil {
-			log.Printf("Error on Cassandra %v", err)
-			return 2 // Server Problem
+		batch.Query(deleteZoneRRsetAtCQL, timestamp, zone, name, rrtype)
+	} else {
+		batch.Query(deleteRRsetAtCQL, timestamp, name, rrtype)
+	}
+	return c.addInserts(batch, rrs, timestamp+1)
+}
+
+// addInserts adds to batch the inserts of rrs, at timestamp when it
+// isn't 0
+func (c *CassandraDB) addInserts(batch *gocql.Batch, rrs []dns.RR, timestamp int64) error {
+	for _, rr := range rrs {
+		rrset, err := EncodeRRSet([]dns.RR{rr})
+		if err != nil {
+			return err
 		}
-	case dns.TypeNS:
-
-		var domainName string
-		var id gocql.UUID
-		var class uint16
-		var ttl uint32
-		var nsdname string
-
-		iter := s.Query(`SELECT * FROM domain_ns WHERE domain_name = ?`, dnsq.Name).Iter()
-		for iter.Scan(&domainName, &id, &class, &nsdname, &ttl) {
-			rr := &dns.NS{
-				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
-				Ns:  nsdname,
-			}
-			m.Answer = append(m.Answer, rr)
+		stmt, args, err := c.insertStatement(rr, rrset, timestamp)
+		if err != nil {
+			return err
 		}
-		if err := iter.Close(); err != nil {
-			log.Printf("Error on Cassandra %v", err)
-			return 2 // Server Problem
+		batch.Query(stmt, args...)
+	}
+	return nil
+}
+
+// insertStatement : insert of the record rr with its encoded rrset on
+// the table of the data model, at timestamp when it isn't 0
+func (c *CassandraDB) insertStatement(rr dns.RR, rrset []byte, timestamp int64) (string, []interface{}, error) {
+	name := rr.Header().Name
+	rrtype := dns.TypeToString[rr.Header().Rrtype]
+	if c.Model != CassandraZonesModel {
+		if timestamp != 0 {
+			return insertRecordAtCQL, []interface{}{name, rrtype, rdata(rr), rrset, timestamp}, nil
 		}
-	case dns.TypeCNAME:
-
-		var domainName string
-		var id gocql.UUID
-		var class uint16
-		var ttl uint32
-		var domainCname string
-
-		iter := s.Query(`SELECT * FROM domain_cname WHERE domain_name = ?`, dnsq.Name).Iter()
-		for iter.Scan(&domainName, &id, &class, &domainCname, &ttl) {
-			rr := &dns.CNAME{
-				Hdr:    dns.RR_Header{Name: domainName, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
-				Target: domainCname,
+		return insertRecordCQL, []interface{}{name, rrtype, rdata(rr), rrset}, nil
+	}
+
+	zone, err := c.zoneOf(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if timestamp != 0 {
+		return insertZoneRecordAtCQL, []interface{}{zone, name, rrtype, rdata(rr), rrset, timestamp}, nil
+	}
+	return insertZoneRecordCQL, []interface{}{zone, name, rrtype, rdata(rr), rrset}, nil
+}
+
+// UploadBatch : adds the records to their RRsets, replacing the SOA and
+// CNAME ones. The records of each partition go in unlogged batches of up
+// to BatchSize statements, applied at once by the replicas of the
+// partition, running BatchConcurrency batches at a time
+func (c *CassandraDB) UploadBatch(ctx context.Context, rrs []dns.RR) error {
+	// RRsets of each partition in the order they come
+	var failed []RecordError
+	var partitions []string
+	keys := make(map[string][]string)
+	sets := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		key := recordKey(rr)
+		partition := key
+		if c.Model == CassandraZonesModel {
+			zone, err := c.zoneOf(rr.Header().Name)
+			if err != nil {
+				failed = append(failed, RecordError{RR: rr, Err: err})
+				continue
 			}
-			m.Answer = append(m.Answer, rr)
-		}
-		if err := iter.Close(); err != nil {
-			log.Printf("Error on Cassandra %v", err)
-			return 2 // Server Problem
+			partition = zone
 		}
-	case dns.TypeSOA:
-
-		var domainName string
-		var id gocql.UUID
-		var class uint16
-		var ttl uint32
-		var mname string
-		var rname string
-		var serial uint32
-		var refresh uint32
-		var retry uint32
-		var expire uint32
-		var minimum uint32
-
-		iter := s.Query(`SELECT * FROM domain_soa WHERE domain_name = ?`, dnsq.Name).Iter()
-		for iter.Scan(&domainName, &id, &class, &expire, &minimum, &mname, &refresh, &retry, &rname, &serial, &ttl) {
-			rr := &dns.SOA{
-				Hdr:     dns.RR_Header{Name: domainName, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
-				Ns:      mname,
-				Mbox:    rname,
-				Serial:  serial,
-				Refresh: refresh,
-				Retry:   retry,
-				Expire:  expire,
-				Minttl:  minimum}
-			m.Answer = append(m.Answer, rr)
+		if _, ok := keys[partition]; !ok {
+			partitions = append(partitions, partition)
 		}
-		if err := iter.Close(); err != nil {
-			log.Printf("Error on Cassandra %v", err)
-			return 2 // Server Problem
+		if _, ok := sets[key]; !ok {
+			keys[partition] = append(keys[partition], key)
 		}
-	case dns.TypePTR:
-
-		var domainName string
-		var id gocql.UUID
-		var class uint16
-		var ttl uint32
-		var ptrdname string
-
-		iter := s.Query(`SELECT * FROM domain_ptr WHERE domain_name = ?`, dnsq.Name).Iter()
-		for iter.Scan(&domainName, &id, &class, &ptrdname, &ttl) {
-			rr := &dns.PTR{
-				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
-				Ptr: ptrdname,
+		sets[key] = mergeRRSet(sets[key], rr)
+	}
+
+	// Split the partitions in batches keeping each RRset, and the delete
+	// replacing it, in one of them
+	var batches [][][]dns.RR
+	for _, partition := range partitions {
+		var current [][]dns.RR
+		statements := 0
+		for _, key := range keys[partition] {
+			if statements > 0 && c.BatchSize > 0 && statements+len(sets[key])+1 > c.BatchSize {
+				batches = append(batches, current)
+				current, statements = nil, 0
 			}
-			m.Answer = append(m.Answer, rr)
-		}
-		if err := iter.Close(); err != nil {
-			log.Printf("Error on Cassandra %v", err)
-			return 2 // Server Problem
+			current = append(current, sets[key])
+			statements += len(sets[key]) + 1
 		}
-	case dns.TypeHINFO:
-
-		var domainName string
-		var id gocql.UUID
-		var class uint16
-		var ttl uint32
-		var cpu string
-		var os string
-
-		iter := s.Query(`SELECT * FROM domain_hinfo WHERE domain_name = ?`, dnsq.Name).Iter()
-		for iter.Scan(&domainName, &id, &class, &cpu, &os, &ttl) {
-			rr := &dns.HINFO{
-				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: ttl},
-				Cpu: cpu,
-				Os:  os,
+		batches = append(batches, current)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	running := make(chan struct{}, c.batchConcurrency())
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	for _, rrsets := range batches {
+		running <- struct{}{}
+		wg.Add(1)
+		go func(rrsets [][]dns.RR) {
+			defer func() { <-running; wg.Done() }()
+			if err := c.executeBatch(ctx, rrsets, now); err != nil {
+				mu.Lock()
+				for _, set := range rrsets {
+					for _, rr := range set {
+						failed = append(failed, RecordError{RR: rr, Err: err})
+					}
+				}
+				mu.Unlock()
 			}
-			m.Answer = append(m.Answer, rr)
-		}
-		if err := iter.Close(); err != nil {
-			log.Printf("Error on Cassandra %v", err)
-			return 2 // Server Problem
+		}(rrsets)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed}
+	}
+	return nil
+}
+
+func (c *CassandraDB) batchConcurrency() int {
+	if c.BatchConcurrency <= 0 {
+		return 1
+	}
+	return c.BatchConcurrency
+}
+
+// executeBatch writes the RRsets of a partition in one unlogged batch.
+// The SOA and CNAME RRsets are replaced at timestamp
+func (c *CassandraDB) executeBatch(ctx context.Context, rrsets [][]dns.RR, timestamp int64) error {
+	batch := c.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+	batch.SetConsistency(c.WriteConsistency)
+	for _, set := range rrsets {
+		var err error
+		switch set[0].Header().Rrtype {
+		case dns.TypeSOA, dns.TypeCNAME:
+			err = c.addReplace(batch, set, timestamp)
+		default:
+			err = c.addInserts(batch, set, 0)
 		}
-	case dns.TypeMX:
-
-		var domainName string
-		var id gocql.UUID
-		var class uint16
-		var ttl uint32
-		var preference uint16
-		var exchange string
-
-		iter := s.Query(`SELECT * FROM domain_mx WHERE domain_name = ?`, dnsq.Name).Iter()
-		for iter.Scan(&domainName, &id, &class, &exchange, &preference, &ttl) {
-			rr := &dns.MX{
-				Hdr:        dns.RR_Header{Name: domainName, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: ttl},
-				Preference: preference,
-				Mx:         exchange,
-			}
-			m.Answer = append(m.Answer, rr)
+		if err != nil {
+			return err
 		}
-		if err := iter.Close(); err != nil {
-			log.Printf("Error on Cassandra %v", err)
-			return 2 // Server Problem
+	}
+	return c.write(ctx, func() error { return c.session.ExecuteBatch(batch) })
+}
+
+// write runs exec until it succeeds, fails with an error that can't be
+// retried or WriteAttempts are spent, waiting an exponential backoff with
+// jitter between attempts. The writes are idempotent so retrying one that
+// timed out after being applied is harmless
+func (c *CassandraDB) write(ctx context.Context, exec func() error) error {
+	backoff := c.MinBackoff
+	for attempt := 1; ; attempt++ {
+		err := exec()
+		if err == nil || !retryableWrite(err) {
+			return err
 		}
-	case dns.TypeTXT:
-
-		var domainName string
-		var id gocql.UUID
-		var class uint16
-		var ttl uint32
-		var current string
-		var data []string
-
-		// TXT records have a list of txt values but sharing ttl and other data
-		iter := s.Query(`SELECT * FROM domain_txt WHERE domain_name = ?`, dnsq.Name).Iter()
-		for iter.Scan(&domainName, &id, &class, &current, &ttl) {
-			data = append(data, current)
+		if attempt >= c.WriteAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
 		}
-		rr := &dns.TXT{
-			Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
-			Txt: data,
+
+		// Wait between half and the whole backoff
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v after %d attempts: %w", ctx.Err(), attempt, err)
+		case <-time.After(wait):
 		}
-		m.Answer = append(m.Answer, rr)
-		if err := iter.Close(); err != nil {
-			log.Printf("Error on Cassandra %v", err)
-			return 2 // Server Problem
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
 		}
 	}
-	if len(m.Answer) >= 1 {
-		return 0 // No error
-	}
-	return 3 // Domain name does not exists
 }
 
-// UploadRR to Cassandra Cluster from line
-func (c *CassandraDB) UploadRR(line string) error {
+// retryableWrite tells if a write failed because of a node or connection
+// problem that another attempt could avoid
+func retryableWrite(err error) bool {
+	switch err.(type) {
+	case *gocql.RequestErrWriteTimeout, *gocql.RequestErrUnavailable:
+		return true
+	}
+	return err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed ||
+		err == gocql.ErrNoConnections
+}
 
-	var values = map[string]int{
-		"IN": 1,
+// HandleFile reads a file containing RRs a uploads them replacing if set
+func (c *CassandraDB) HandleFile(ctx context.Context, location string, replace bool) {
+	rrs, err := utils.ReadAndParseZoneFile(location, "")
+	if err != nil {
+		log.Printf("Error reading %s: %v", location, err)
+		return
 	}
 
-	s := c.session
-	// Capture tokens
-	tk := strings.Split(line, "\t")
-	var dnsType string = tk[3]
-
-	switch dnsType {
-	case "A":
-		if err := s.Query(`INSERT INTO domain_a (domain_name, id, class, ttl, address) VALUES (?, ?, ?, ?, ?)`,
-			tk[0], gocql.TimeUUID(), values[tk[2]], tk[1], tk[4]).Exec(); err != nil {
-			if err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed {
-				c.UploadRR(line)
-			} else {
-				log.Printf("Error uploading A %s", tk)
-				return err
-				// Retry
-			}
+	var keys []string
+	sets := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		// The zone of the file is known from now on
+		if rr.Header().Rrtype == dns.TypeSOA && c.Model == CassandraZonesModel {
+			c.addZone(rr.Header().Name)
 		}
-	case "NS":
-		if err := s.Query(`INSERT INTO domain_ns (domain_name, id, class, ttl, nsdname) VALUES (?, ?, ?, ?, ?)`,
-			tk[0], gocql.TimeUUID(), values[tk[2]], tk[1], tk[4]).Exec(); err != nil {
-			if err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed {
-				// Retry
-				c.UploadRR(line)
-			} else {
-				log.Printf("Error uploading NS %s", tk)
-				return err
-			}
-		}
-	case "CNAME":
-		if err := s.Query(`INSERT INTO domain_cname (domain_name, id, class, ttl, domain_cname) VALUES (?, ?, ?, ?, ?)`,
-			tk[0], gocql.TimeUUID(), values[tk[2]], tk[1], tk[4]).Exec(); err != nil {
-			if err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed {
-				c.UploadRR(line)
-			} else {
-				log.Printf("Error uploading CNAME %s", tk)
-				return err
-				// Retry
-			}
+		key := recordKey(rr)
+		if _, ok := sets[key]; !ok {
+			keys = append(keys, key)
 		}
-	case "SOA":
-		soaData := strings.Split(tk[4], " ")
-		if err := s.Query(`INSERT INTO domain_soa (domain_name, id, class, ttl, mname, rname, serial, refresh, retry, expire, minimum) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			tk[0], gocql.TimeUUID(), values[tk[2]], tk[1], soaData[0], soaData[1], soaData[2], soaData[3], soaData[4], soaData[5], soaData[6]).Exec(); err != nil {
-			if err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed {
-				c.UploadRR(line)
-			} else {
-				log.Printf("Error uploading SOA %s", tk)
-				return err
-				// Retry
-			}
-		}
-	case "PTR":
-		// Check that domain name is in-addr.arpa compliant
-		// Just in case the record was added as an IP and answer
-		var domain string = tk[0]
-		if strings.Contains(domain, "in-addr.arpa") {
-			domain, _ = dns.ReverseAddr(domain)
-		}
-		if err := s.Query(`INSERT INTO domain_ptr (domain_name, id, class, ttl, ptrdname) VALUES (?, ?, ?, ?, ?)`,
-			domain, gocql.TimeUUID(), values[tk[2]], tk[1], tk[4]).Exec(); err != nil {
-			if err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed {
-				c.UploadRR(line)
-			} else {
-				log.Printf("Error uploading PTR %s", tk)
-				return err
-				// Retry
-			}
-		}
-	case "HINFO":
-		hinfoData := strings.Split(tk[4], " ")
-		if err := s.Query(`INSERT INTO domain_hinfo (domain_name, id, class, ttl, cpu, os) VALUES (?, ?, ?, ?, ?, ?)`,
-			tk[0], gocql.TimeUUID(), values[tk[2]], tk[1], hinfoData[0], hinfoData[1]).Exec(); err != nil {
-			if err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed {
-				c.UploadRR(line)
-			} else {
-				log.Printf("Error uploading HINFO %s", tk)
-				return err
-				// Retry
-			}
-		}
-	case "MX":
-		mxData := strings.Split(tk[4], " ")
-		if err := s.Query(`INSERT INTO domain_mx (domain_name, id, class, ttl, preference, exchange) VALUES (?, ?, ?, ?, ?, ?)`,
-			tk[0], gocql.TimeUUID(), values[tk[2]], tk[1], mxData[0], mxData[1]).Exec(); err != nil {
-			if err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed {
-				c.UploadRR(line)
-			} else {
-				log.Printf("Error uploading MX %s", tk)
-				return err
-				// Retry
+		sets[key] = append(sets[key], rr)
+	}
+	for _, key := range keys {
+		if replace {
+			err = c.ReplaceRRset(ctx, sets[key])
+		} else {
+			for _, rr := range sets[key] {
+				if err = c.UploadRR(ctx, rr.String()); err != nil {
+					break
+				}
 			}
 		}
-	case "TXT":
-		if err := s.Query(`INSERT INTO domain_txt (domain_name, id, class, ttl, txt) VALUES (?, ?, ?, ?, ?)`,
-			tk[0], gocql.TimeUUID(), values[tk[2]], tk[1], strings.ReplaceAll(tk[4], "\"", "")).Exec(); err != nil {
-			if err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed {
-				c.UploadRR(line)
-			} else {
-				log.Printf("Error uploading TXT %s", tk)
-				return err
-				// Retry
-			}
+		if err != nil {
+			log.Printf("Error uploading %s: %v", location, err)
+			return
 		}
 	}
-	return nil
+	log.Printf("Uploaded %d records from %s", len(rrs), location)
 }
 
-// HandleFile reads a file containing RRs a uploads them replacing if set
-func (c *CassandraDB) HandleFile(location string, replace bool) {
-	log.Println("Not implemented")
-	return
+// Ping : reads the local node information
+func (c *CassandraDB) Ping(ctx context.Context) error {
+	return c.session.Query(`SELECT release_version FROM system.local`).WithContext(ctx).Exec()
 }
 
 // Disconnect : ends the cassandra session
@@ -332,38 +425,66 @@ func (c *CassandraDB) Disconnect() {
 	c.session.Close()
 }
 
-// ConnectDB : Starts a cassandra session to a cluster given the ips.
-// If it fails it dies
+// ConnectDB : Starts a cassandra session to a cluster given the ips,
+// migrating the schema first when AutoMigrate is set. If it fails it dies
 func (c *CassandraDB) ConnectDB(ips []string) {
-	cluster := gocql.NewCluster(ips...)
-	cluster.Keyspace = "dns"
-	cluster.Consistency = gocql.Quorum
+	if c.AutoMigrate {
+		if err := c.Migrate(ips); err != nil {
+			log.Fatalf("Couldn't migrate the Cassandra schema: %v", err)
+		}
+	}
 
 	// Have one session to interact with the db using goroutines
 	// The session executor launches a go routine to fetch the results
-	session, err := cluster.CreateSession()
+	session, err := c.newCluster(ips, c.Keyspace).CreateSession()
 	if err != nil {
-		log.Fatalf("Couldn't connect to Cassandra Cluster: %v", err)
+		log.Fatalf("Couldn't connect to Cassandra Cluster, "+
+			"if keyspace %s doesn't exist create it with the migrate command: %v", c.Keyspace, err)
 	}
 	c.session = session
 }
 
-// Handle : function to call on the dns server when a package is received.
-// Prepares the package and calls Cassandra to fill it up
-func (c *CassandraDB) Handle(w dns.ResponseWriter, r *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-
-	if c.Print {
-		logQuery(r)
+// newCluster : cluster configuration of the driver options using keyspace
+func (c *CassandraDB) newCluster(ips []string, keyspace string) *gocql.ClusterConfig {
+	cluster := gocql.NewCluster(ips...)
+	cluster.Keyspace = keyspace
+	cluster.Consistency = c.ReadConsistency
+	// Send each request to a replica of its partition, picking them and
+	// the other hosts from the local datacenter when there is one
+	if c.LocalDC != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
+			gocql.DCAwareRoundRobinPolicy(c.LocalDC), gocql.NonLocalReplicasFallback())
+	} else {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy())
 	}
-
-	if r.MsgHdr.Authoritative {
-		m.Rcode = 4 // Not implemented
-		w.WriteMsg(m)
+	if c.Timeout > 0 {
+		cluster.Timeout = c.Timeout
+	}
+	if c.ConnectTimeout > 0 {
+		cluster.ConnectTimeout = c.ConnectTimeout
+	}
+	if c.NumConns > 0 {
+		cluster.NumConns = c.NumConns
+	}
+	if c.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: c.Username, Password: c.Password}
+	}
+	if c.TLSConfig != nil {
+		// gocql skips the verification unless EnableHostVerification is set
+		cluster.SslOpts = &gocql.SslOptions{
+			Config:                 c.TLSConfig.Clone(),
+			EnableHostVerification: !c.TLSConfig.InsecureSkipVerify,
+		}
+	}
+	if c.MinBackoff > 0 {
+		c.readRetry = &gocql.ExponentialBackoffRetryPolicy{NumRetries: c.ReadRetries, Min: c.MinBackoff, Max: c.MaxBackoff}
+	} else {
+		c.readRetry = &gocql.SimpleRetryPolicy{NumRetries: c.ReadRetries}
+	}
+	if c.SpeculativeAttempts > 0 {
+		c.speculative = &gocql.SimpleSpeculativeExecution{NumAttempts: c.SpeculativeAttempts, TimeoutDelay: c.SpeculativeDelay}
 	} else {
-		rcode := c.MakeQuery(m)
-		m.Rcode = rcode
-		w.WriteMsg(m)
+		c.speculative = gocql.NonSpeculativeExecution{}
 	}
+	return cluster
 }
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// SetZones : replaces the zones the records belong to on the zones data
+// model. Zones of the files uploaded with HandleFile are added to them
+func (c *CassandraDB) SetZones(zones []string) {
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	canonical := make([]string, len(zones))
+	for i, zone := range zones {
+		canonical[i] = dns.CanonicalName(zone)
+	}
+	c.zones.Store(canonical)
+}
+
+// addZone adds zone to the known zones
+func (c *CassandraDB) addZone(zone string) {
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	zone = dns.CanonicalName(zone)
+	current, _ := c.zones.Load().([]string)
+	for _, known := range current {
+		if known == zone {
+			return
+		}
+	}
+	zones := make([]string, len(current), len(current)+1)
+	copy(zones, current)
+	c.zones.Store(append(zones, zone))
+}
+
+// zoneOf : partition key of the records of name
+func (c *CassandraDB) zoneOf(name string) (string, error) {
+	zones, _ := c.zones.Load().([]string)
+	zone := closestZone(zones, name)
+	if zone == "" {
+		return "", fmt.Errorf("no configured zone contains %s", name)
+	}
+	return zone, nil
+}
+
+// queryZone answers m on the zones data model. Every RRset of the name
+// comes in one read of the zone partition, which also tells a name
+// without records of the type (NODATA) from a missing one and answers
+// ANY queries
+func (c *CassandraDB) queryZone(ctx context.Context, m *dns.Msg) error {
+	dnsq := m.Question[0]
+	zone, err := c.zoneOf(dnsq.Name)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	var rrtype string
+	var rrset []byte
+	exists := false
+	iter := c.session.Query(selectNameCQL, zone, dnsq.Name).WithContext(ctx).
+		Consistency(c.ReadConsistency).Idempotent(true).
+		RetryPolicy(c.readRetry).SetSpeculativeExecutionPolicy(c.speculative).Iter()
+	for iter.Scan(&rrtype, &rrset) {
+		exists = true
+		qtype := dns.StringToType[rrtype]
+		if dnsq.Qtype != dns.TypeANY && qtype != dnsq.Qtype {
+			continue
+		}
+		rrs, err := DecodeRRSet(dnsq.Name, qtype, rrset)
+		if err != nil {
+			iter.Close()
+			return corrupt("Cassandra", dnsq.Name+":"+rrtype, err)
+		}
+		m.Answer = append(m.Answer, rrs...)
+	}
+	if err := iter.Close(); err != nil {
+		return backendError(ctx, "Cassandra", err)
+	}
+
+	if !exists {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CopyRecords : copies the records of domain_records into zone_records,
+// moving a cluster to the zones data model. Records outside every known
+// zone are skipped. The copy is idempotent and can be repeated until the
+// servers switch to the zones model
+func (c *CassandraDB) CopyRecords(ctx context.Context) error {
+	var name, rrtype, data string
+	var rrset []byte
+	copied, skipped := 0, 0
+	iter := c.session.Query(`SELECT domain_name, type, rdata, rrset FROM domain_records`).
+		WithContext(ctx).Consistency(c.ReadConsistency).PageSize(1000).Iter()
+	for iter.Scan(&name, &rrtype, &data, &rrset) {
+		zone, err := c.zoneOf(name)
+		if err != nil {
+			skipped++
+			continue
+		}
+		// Copy the values before the next Scan reuses the slice
+		args := []interface{}{zone, name, rrtype, data, append([]byte(nil), rrset...)}
+		err = c.write(ctx, func() error {
+			return c.session.Query(insertZoneRecordCQL, args...).
+				WithContext(ctx).Consistency(c.WriteConsistency).Exec()
+		})
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("copying %s %s: %v", name, rrtype, err)
+		}
+		copied++
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	log.Printf("Copied %d records to zone_records, %d outside the known zones skipped", copied, skipped)
+	return nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// CoalescedDriver : DBDriver sharing a single driver query among the
+// concurrent queries of the same name and type. The shared query runs
+// with its own Timeout, not the context of the query that started it, and
+// each query waits for it at most until its own context is done
+type CoalescedDriver struct {
+	DBDriver
+	// Name of the database in the errors and logs
+	DB      string
+	Timeout time.Duration
+	lookups singleflight.Group
+}
+
+// lookupResult : answer shared by the queries waiting on a lookup
+type lookupResult struct {
+	answer []dns.RR
+	err    error
+}
+
+// NewCoalescedDriver : wraps driver, running the shared queries for at
+// most timeout
+func NewCoalescedDriver(driver DBDriver, db string, timeout time.Duration) *CoalescedDriver {
+	return &CoalescedDriver{DBDriver: driver, DB: db, Timeout: timeout}
+}
+
+// SetZones : replaces the configured zone names on the wrapped driver
+// when it uses them
+func (c *CoalescedDriver) SetZones(zones []string) {
+	if driver, ok := c.DBDriver.(ZoneAware); ok {
+		driver.SetZones(zones)
+	}
+}
+
+// MakeQuery : answers m with copies of the answer of the driver query
+// shared with the concurrent queries of the same RRset
+func (c *CoalescedDriver) MakeQuery(ctx context.Context, m *dns.Msg) error {
+	q := m.Question[0]
+	results := c.lookups.DoChan(cacheKey(q.Name, q.Qtype), func() (interface{}, error) {
+		queryCtx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		defer cancel()
+		query := new(dns.Msg)
+		query.SetQuestion(q.Name, q.Qtype)
+		err := c.DBDriver.MakeQuery(queryCtx, query)
+		return lookupResult{answer: query.Answer, err: err}, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return backendError(ctx, c.DB, ctx.Err())
+	case shared := <-results:
+		result := shared.Val.(lookupResult)
+		for _, rr := range result.answer {
+			m.Answer = append(m.Answer, dns.Copy(rr))
+		}
+		return result.err
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// DnstapLogger : sends AUTH_QUERY and AUTH_RESPONSE dnstap messages to a
+// framestream output. Messages are queued on a buffered channel and dropped
+// when it is full so the handler never waits on the output.
+type DnstapLogger struct {
+	target   string
+	output   dnstap.Output
+	queue    chan *dnstap.Dnstap
+	done     chan struct{}
+	identity []byte
+	version  []byte
+
+	// Guards queue against messages sent after Close
+	mu     sync.RWMutex
+	closed bool
+
+	// Log one out of every sample queries, 0 or 1 logs everything
+	sample  uint64
+	counter uint64
+	dropped uint64
+}
+
+// NewDnstapLogger : opens the dnstap output given by target and starts the
+// writer loop. The target is either "unix:/path/to.sock", "tcp:host:port"
+// or the name of a file that will be created or truncated.
+func NewDnstapLogger(target string, sample, bufferSize int) (*DnstapLogger, error) {
+	var output dnstap.Output
+	var err error
+
+	switch {
+	case strings.HasPrefix(target, "unix:"):
+		var addr *net.UnixAddr
+		addr, err = net.ResolveUnixAddr("unix", strings.TrimPrefix(target, "unix:"))
+		if err == nil {
+			output, err = dnstap.NewFrameStreamSockOutput(addr)
+		}
+	case strings.HasPrefix(target, "tcp:"):
+		var addr *net.TCPAddr
+		addr, err = net.ResolveTCPAddr("tcp", strings.TrimPrefix(target, "tcp:"))
+		if err == nil {
+			output, err = dnstap.NewFrameStreamSockOutput(addr)
+		}
+	default:
+		output, err = dnstap.NewFrameStreamOutputFromFilename(target)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dnstap output %s: %v", target, err)
+	}
+
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	identity, _ := os.Hostname()
+	t := &DnstapLogger{
+		target:   target,
+		output:   output,
+		queue:    make(chan *dnstap.Dnstap, bufferSize),
+		done:     make(chan struct{}),
+		identity: []byte(identity),
+		version:  []byte("goKvsDns"),
+		sample:   uint64(sample),
+	}
+	go output.RunOutputLoop()
+	go t.writeLoop()
+	return t, nil
+}
+
+// writeLoop marshals the queued messages and hands them to the output
+func (t *DnstapLogger) writeLoop() {
+	defer close(t.done)
+	out := t.output.GetOutputChannel()
+	for msg := range t.queue {
+		frame, err := proto.Marshal(msg)
+		if err != nil {
+			log.Printf("Error marshaling dnstap message: %v", err)
+			continue
+		}
+		out <- frame
+	}
+}
+
+// Sample : tells if the current query should be logged.
+// Safe to call on a nil logger.
+func (t *DnstapLogger) Sample() bool {
+	if t == nil {
+		return false
+	}
+	if t.sample <= 1 {
+		return true
+	}
+	return atomic.AddUint64(&t.counter, 1)%t.sample == 0
+}
+
+// LogQuery : queues an AUTH_QUERY message for the request
+func (t *DnstapLogger) LogQuery(w dns.ResponseWriter, r *dns.Msg, received time.Time) {
+	msg := t.newMessage(dnstap.Message_AUTH_QUERY, w)
+	msg.QueryMessage, _ = r.Pack()
+	msg.QueryTimeSec, msg.QueryTimeNsec = dnstapTime(received)
+	t.enqueue(msg)
+}
+
+// LogResponse : queues an AUTH_RESPONSE message for the reply
+func (t *DnstapLogger) LogResponse(w dns.ResponseWriter, m *dns.Msg, received time.Time) {
+	msg := t.newMessage(dnstap.Message_AUTH_RESPONSE, w)
+	msg.ResponseMessage, _ = m.Pack()
+	msg.QueryTimeSec, msg.QueryTimeNsec = dnstapTime(received)
+	msg.ResponseTimeSec, msg.ResponseTimeNsec = dnstapTime(time.Now())
+	t.enqueue(msg)
+}
+
+// Dropped : number of messages discarded because the buffer was full
+func (t *DnstapLogger) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// sameOptions tells if the logger was opened with these options.
+// Safe to call on a nil logger.
+func (t *DnstapLogger) sameOptions(target string, sample, bufferSize int) bool {
+	if t == nil {
+		return false
+	}
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	return t.target == target && t.sample == uint64(sample) && cap(t.queue) == bufferSize
+}
+
+// Close : flushes the pending messages and closes the output. Messages
+// logged afterwards are dropped
+func (t *DnstapLogger) Close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	<-t.done
+	t.output.Close()
+	if dropped := t.Dropped(); dropped > 0 {
+		log.Printf("dnstap dropped %d messages", dropped)
+	}
+}
+
+func (t *DnstapLogger) enqueue(msg *dnstap.Message) {
+	dt := &dnstap.Dnstap{
+		Identity: t.identity,
+		Version:  t.version,
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Message:  msg,
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- dt:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// newMessage fills the socket information of a dnstap message
+func (t *DnstapLogger) newMessage(kind dnstap.Message_Type, w dns.ResponseWriter) *dnstap.Message {
+	msg := &dnstap.Message{Type: kind.Enum()}
+
+	var remoteIP, localIP net.IP
+	var remotePort, localPort int
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		msg.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+		remoteIP, remotePort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		msg.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+		remoteIP, remotePort = addr.IP, addr.Port
+	}
+	switch addr := w.LocalAddr().(type) {
+	case *net.UDPAddr:
+		localIP, localPort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		localIP, localPort = addr.IP, addr.Port
+	}
+
+	if ip4 := remoteIP.To4(); ip4 != nil {
+		msg.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		msg.QueryAddress = ip4
+		msg.ResponseAddress = localIP.To4()
+	} else {
+		msg.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		msg.QueryAddress = remoteIP
+		msg.ResponseAddress = localIP.To16()
+	}
+	qport, rport := uint32(remotePort), uint32(localPort)
+	msg.QueryPort = &qport
+	msg.ResponsePort = &rport
+	return msg
+}
+
+func dnstapTime(t time.Time) (*uint64, *uint32) {
+	sec := uint64(t.Unix())
+	nsec := uint32(t.Nanosecond())
+	return &sec, &nsec
+}
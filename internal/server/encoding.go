@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Every driver stores the records of a name and type with the same
+// versioned JSON encoding:
+//
+//	{"v":1,"rrs":[{"ttl":3600,"data":"10 mail.example.com."}]}
+//
+// data is the RDATA in presentation format, keeping the quoting and
+// escapes of the TXT and HINFO strings, so any value can be stored and
+// read back by other tools with a zone file parser.
+
+// EncodingVersion : version written by EncodeRRSet
+const EncodingVersion = 1
+
+type storedRRSet struct {
+	Version int            `json:"v"`
+	Records []storedRecord `json:"rrs"`
+}
+
+type storedRecord struct {
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// EncodeRRSet : stored form of records sharing name and type
+func EncodeRRSet(rrs []dns.RR) ([]byte, error) {
+	set := storedRRSet{Version: EncodingVersion, Records: make([]storedRecord, len(rrs))}
+	for i, rr := range rrs {
+		set.Records[i] = storedRecord{TTL: rr.Header().Ttl, Data: rdata(rr)}
+	}
+	return json.Marshal(set)
+}
+
+// DecodeRRSet : records of name and type from their stored form, or from
+// the version 0 form of the first releases
+func DecodeRRSet(name string, rrtype uint16, data []byte) ([]dns.RR, error) {
+	if isLegacy(data) {
+		return decodeLegacy(name, rrtype, data)
+	}
+	var set storedRRSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("bad encoding: %v", err)
+	}
+	if set.Version != EncodingVersion {
+		return nil, fmt.Errorf("unknown encoding version %d", set.Version)
+	}
+	typeName, ok := dns.TypeToString[rrtype]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %d", rrtype)
+	}
+
+	rrs := make([]dns.RR, 0, len(set.Records))
+	for _, record := range set.Records {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), record.TTL, typeName, record.Data))
+		if err != nil {
+			return nil, fmt.Errorf("bad %s record %q: %v", typeName, record.Data, err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("empty %s record", typeName)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// ParseRecord : reads a record in presentation format as uploaded from a
+// zone file. PTR records whose owner is an IP address are stored under
+// its reverse name
+func ParseRecord(line string) (dns.RR, error) {
+	tk := strings.Split(line, "\t")
+	if len(tk) > 3 && tk[3] == "PTR" && net.ParseIP(strings.TrimSuffix(tk[0], ".")) != nil {
+		reverse, err := dns.ReverseAddr(strings.TrimSuffix(tk[0], "."))
+		if err != nil {
+			return nil, err
+		}
+		tk[0] = reverse
+		line = strings.Join(tk, "\t")
+	}
+	rr, err := dns.NewRR(line)
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("no record in %q", line)
+	}
+	return rr, nil
+}
+
+// recordKey : key of the RRset of rr on the key value stores
+func recordKey(rr dns.RR) string {
+	return rr.Header().Name + ":" + dns.TypeToString[rr.Header().Rrtype]
+}
+
+// rdata : RDATA of rr in presentation format
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// mergeRRSet adds rr to rrs replacing the record with the same data.
+// SOA and CNAME can only have one record so rr replaces the set
+func mergeRRSet(rrs []dns.RR, rr dns.RR) []dns.RR {
+	switch rr.Header().Rrtype {
+	case dns.TypeSOA, dns.TypeCNAME:
+		return []dns.RR{rr}
+	}
+	data := rdata(rr)
+	for i := range rrs {
+		if rdata(rrs[i]) == data {
+			rrs[i] = rr
+			return rrs
+		}
+	}
+	return append(rrs, rr)
+}
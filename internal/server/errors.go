@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/gocql/gocql"
+	"github.com/miekg/dns"
+	"go.etcd.io/etcd/clientv3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by the drivers, wrapped with the backend and the
+// original cause. The handler maps them to rcodes and Extended DNS
+// Errors (RFC 8914).
+var (
+	// ErrNotFound : the name has no records of the type
+	ErrNotFound = errors.New("not found")
+	// ErrTimeout : the backend didn't answer within the deadline
+	ErrTimeout = errors.New("timeout")
+	// ErrUnavailable : the backend can't be reached or has no quorum
+	ErrUnavailable = errors.New("unavailable")
+	// ErrCorrupt : a stored value can't be decoded
+	ErrCorrupt = errors.New("corrupt value")
+	// ErrStale : the answer is an expired cache entry given because the
+	// backend failed
+	ErrStale = errors.New("stale answer")
+)
+
+// backendError classifies err as a timeout, the backend being unavailable
+// or any other failure, logging and counting it
+func backendError(ctx context.Context, db string, err error) error {
+	var kind error
+	netErr, isNetErr := err.(net.Error)
+	switch {
+	case ctx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) ||
+		err == gocql.ErrTimeoutNoResponse || isNetErr && netErr.Timeout():
+		kind = ErrTimeout
+	case isNetErr || err == gocql.ErrNoConnections || err == gocql.ErrConnectionClosed ||
+		err == clientv3.ErrNoAvailableEndpoints || status.Code(err) == codes.Unavailable:
+		kind = ErrUnavailable
+	default:
+		if _, ok := err.(*gocql.RequestErrUnavailable); ok {
+			kind = ErrUnavailable
+		}
+	}
+
+	if kind == ErrTimeout {
+		backendTimeouts.Add(1)
+		log.Printf("Timeout on %s %v", db, err)
+	} else {
+		backendErrors.Add(1)
+		log.Printf("Error on %s %v", db, err)
+	}
+	return &backendFailure{db: db, kind: kind, cause: err}
+}
+
+// corrupt reports a value of key that can't be decoded
+func corrupt(db, key string, err error) error {
+	log.Printf("Corrupt value on %s %s: %v", db, key, err)
+	return &backendFailure{db: db, kind: ErrCorrupt, cause: fmt.Errorf("%s: %v", key, err)}
+}
+
+// backendFailure : failure of a backend of one of the kinds above, or
+// any other when kind is nil. The cause is only logged, clients are told
+// the backend and the kind
+type backendFailure struct {
+	db    string
+	kind  error
+	cause error
+}
+
+func (e *backendFailure) Error() string {
+	if e.kind == nil {
+		return fmt.Sprintf("%s: %v", e.db, e.cause)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.db, e.kind, e.cause)
+}
+
+func (e *backendFailure) Unwrap() error {
+	return e.kind
+}
+
+// staleAnswer : an expired cache entry answered because the backend
+// failed, with the rcode it was cached with
+type staleAnswer struct {
+	rcode int
+	cause error
+}
+
+func (e *staleAnswer) Error() string {
+	if e.cause == nil {
+		return ErrStale.Error()
+	}
+	return fmt.Sprintf("%v: %v", ErrStale, e.cause)
+}
+
+func (e *staleAnswer) Unwrap() error {
+	return ErrStale
+}
+
+// publicText : description of err given to clients in the Extended DNS
+// Error, without the addresses, keys and driver messages of the cause
+func publicText(err error) string {
+	var stale *staleAnswer
+	if errors.As(err, &stale) {
+		if stale.cause == nil {
+			return "stale answer"
+		}
+		return "stale answer, " + publicText(stale.cause)
+	}
+	var failure *backendFailure
+	switch {
+	case errors.Is(err, ErrCorrupt):
+		return "corrupt record"
+	case errors.As(err, &failure) && failure.kind != nil:
+		return failure.db + " " + failure.kind.Error()
+	case errors.As(err, &failure):
+		return failure.db + " error"
+	}
+	return "backend error"
+}
+
+// rcodeError : error of a cached rcode
+func rcodeError(rcode int) error {
+	if rcode == dns.RcodeNameError {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// errorRcode : rcode of a driver error
+func errorRcode(err error) int {
+	switch {
+	case err == nil:
+		return dns.RcodeSuccess
+	case errors.Is(err, ErrNotFound):
+		return dns.RcodeNameError
+	default:
+		return dns.RcodeServerFailure
+	}
+}
+
+// setError sets the rcode for the error of the driver on the reply m and,
+// when the request r uses EDNS, an Extended DNS Error telling the cause
+func setError(r, m *dns.Msg, err error) {
+	m.Rcode = errorRcode(err)
+	var stale *staleAnswer
+	if errors.As(err, &stale) {
+		m.Rcode = stale.rcode
+	}
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	var code uint16
+	switch {
+	case errors.Is(err, ErrStale) && m.Rcode == dns.RcodeNameError:
+		code = dns.ExtendedErrorCodeStaleNXDOMAINAnswer
+	case errors.Is(err, ErrStale):
+		code = dns.ExtendedErrorCodeStaleAnswer
+	case errors.Is(err, ErrTimeout):
+		code = dns.ExtendedErrorCodeNoReachableAuthority
+	case errors.Is(err, ErrUnavailable):
+		code = dns.ExtendedErrorCodeNetworkError
+	case errors.Is(err, ErrCorrupt):
+		code = dns.ExtendedErrorCodeInvalidData
+	default:
+		code = dns.ExtendedErrorCodeOther
+	}
+	reply := m.SetEdns0(dns.DefaultMsgSize, opt.Do()).IsEdns0()
+	reply.Option = append(reply.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: publicText(err)})
+}
+
+// RecordError : record of a batch that couldn't be uploaded
+type RecordError struct {
+	RR  dns.RR
+	Err error
+}
+
+// BatchError : records of a batch upload that failed, the others were
+// uploaded
+type BatchError struct {
+	Failed []RecordError
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d records failed, first %s: %v", len(e.Failed), e.Failed[0].RR.Header().Name, e.Failed[0].Err)
+}
@@ -2,12 +2,14 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
-	"net"
-	"strconv"
-	"strings"
+	"math/rand"
 	"time"
 
+	"github.com/dario617/goKvsDns/internal/utils"
 	"github.com/miekg/dns"
 	"go.etcd.io/etcd/clientv3"
 	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
@@ -15,9 +17,23 @@ import (
 
 // EtcdDB : Implements DBDriver and holds the etcd client
 type EtcdDB struct {
-	client  *clientv3.Client
-	Timeout time.Duration
-	Print   bool
+	client      *clientv3.Client
+	Timeout     time.Duration
+	DialTimeout time.Duration
+	Print       bool
+	// Limits of the cluster for a single transaction, 0 means no limit
+	MaxTxnOps       int
+	MaxRequestBytes int
+	// Tries of a transaction conflicting with other writers, waiting an
+	// exponential backoff with jitter between MinBackoff and MaxBackoff
+	WriteAttempts int
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	// etcd auth user when Username is set and client TLS, with the client
+	// certificate, when TLSConfig isn't nil
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
 }
 
 // Disconnect : Closes the Ectd client
@@ -25,11 +41,20 @@ func (edb *EtcdDB) Disconnect() {
 	edb.client.Close()
 }
 
+// Ping : makes a linearizable read, which needs a working quorum
+func (edb *EtcdDB) Ping(ctx context.Context) error {
+	_, err := edb.client.Get(ctx, "health")
+	return err
+}
+
 // ConnectDB : assign etcd cluster client given the IPs and ports
 func (edb *EtcdDB) ConnectDB(ips []string) {
 	cli, err := clientv3.New(clientv3.Config{
 		Endpoints:   ips,
-		DialTimeout: 5 * time.Second,
+		DialTimeout: edb.DialTimeout,
+		Username:    edb.Username,
+		Password:    edb.Password,
+		TLS:         edb.TLSConfig,
 	})
 	if err != nil {
 		log.Fatalf("Error while connecting to Etcd cluster %v", err)
@@ -37,13 +62,10 @@ func (edb *EtcdDB) ConnectDB(ips []string) {
 	edb.client = cli
 }
 
-// recoverKey  from Etcd cluster using a timeout
-func (edb *EtcdDB) recoverKey(key string) (string, error) {
+// recoverKey  from Etcd cluster within the deadline of ctx
+func (edb *EtcdDB) recoverKey(ctx context.Context, key string) (string, error) {
 	cli := edb.client
-	requestTimeout := edb.Timeout
-	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	resp, err := cli.Get(ctx, key)
-	defer cancel()
 
 	if err != nil {
 		switch err {
@@ -65,409 +87,238 @@ func (edb *EtcdDB) recoverKey(key string) (string, error) {
 	return string(resp.Kvs[0].Value), nil
 }
 
-// putValueOnSet checks if value is present on set (a line). If not then it adds it
-// A value is described the value in a pair TTL Value
-func (edb *EtcdDB) putValueOnSet(key, value *string) error {
-	// Recover full value
-	resp, err := edb.recoverKey(*key)
-	if err != nil {
-		return err
+// putRR adds rr to the RRset stored on its key
+func (edb *EtcdDB) putRR(ctx context.Context, rr dns.RR) error {
+	return edb.putRRs(ctx, []dns.RR{rr}, false)
+}
+
+// putRRs adds the records to their RRsets, or replaces the RRsets with
+// them if replace is set. The RRsets are written in as few transactions
+// as the MaxTxnOps and MaxRequestBytes limits of the cluster allow
+func (edb *EtcdDB) putRRs(ctx context.Context, rrs []dns.RR, replace bool) error {
+	var keys []string
+	sets := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		key := recordKey(rr)
+		if _, ok := sets[key]; !ok {
+			keys = append(keys, key)
+		}
+		sets[key] = append(sets[key], rr)
 	}
 
-	var repeated bool = false
-	records := strings.Split(resp, ",")
-	if resp != "" {
-		// Value ignoring TTL
-		val := strings.Split(*value, " ")[1]
-		// Check that we are not repeating our selves
-		for i := range records {
-			recordValue := strings.Split(records[i], " ")[1]
-			if recordValue == val {
-				repeated = true
-				// If repeated replace the value at position i
-				records[i] = *value
-				break
-			}
+	maxOps := edb.MaxTxnOps
+	if maxOps <= 0 {
+		maxOps = len(keys)
+	}
+	for start := 0; start < len(keys); start += maxOps {
+		end := start + maxOps
+		if end > len(keys) {
+			end = len(keys)
+		}
+		txnCtx, cancel := context.WithTimeout(ctx, edb.Timeout)
+		err := edb.commitRRsets(txnCtx, keys[start:end], sets, replace)
+		cancel()
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	var newValue string = resp
-	// Create new answer set
-	if !repeated {
-		if newValue == "" {
-			newValue = *value
-		} else {
-			newValue = resp + "," + *value
+// errTxnTooLarge : the transaction is over MaxRequestBytes
+var errTxnTooLarge = errors.New("transaction too large")
+
+// commitRRsets writes the RRsets of keys in one transaction that only
+// succeeds when none of them changed since they were read, retrying it
+// otherwise up to WriteAttempts times with a backoff. Transactions over
+// MaxRequestBytes are split in halves
+func (edb *EtcdDB) commitRRsets(ctx context.Context, keys []string, sets map[string][]dns.RR, replace bool) error {
+	backoff := edb.MinBackoff
+	for attempt := 1; ; attempt++ {
+		err := edb.commitOnce(ctx, keys, sets, replace)
+		switch {
+		case err == errTxnTooLarge && len(keys) > 1:
+			half := len(keys) / 2
+			if err := edb.commitRRsets(ctx, keys[:half], sets, replace); err != nil {
+				return err
+			}
+			return edb.commitRRsets(ctx, keys[half:], sets, replace)
+		case err == errTxnTooLarge:
+			return fmt.Errorf("RRset %s is over the %d bytes request limit", keys[0], edb.MaxRequestBytes)
+		case err != errTxnConflict:
+			return err
+		case attempt >= edb.WriteAttempts:
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		// Wait between half and the whole backoff
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v after %d attempts: %w", ctx.Err(), attempt, err)
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > edb.MaxBackoff {
+			backoff = edb.MaxBackoff
 		}
-	} else {
-		newValue = strings.Join(records, ",")
-	}
-	cli := edb.client
-	requestTimeout := edb.Timeout
-	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-	_, err = cli.Put(ctx, *key, newValue)
-	cancel()
-	if err != nil {
-		return err
 	}
-	return nil
 }
 
-// putTXTOnList by reading the value: [TTL, Value] and appending to the
-// string RR list if the TTL is the same
-func (edb *EtcdDB) putTXTOnList(key *string, value []string) error {
-	// Recover full value
-	resp, err := edb.recoverKey(*key)
+// errTxnConflict : an RRset changed between the read and the write
+var errTxnConflict = errors.New("transaction conflict")
+
+func (edb *EtcdDB) commitOnce(ctx context.Context, keys []string, sets map[string][]dns.RR, replace bool) error {
+	gets := make([]clientv3.Op, len(keys))
+	for i, key := range keys {
+		gets[i] = clientv3.OpGet(key)
+	}
+	read, err := edb.client.Txn(ctx).Then(gets...).Commit()
 	if err != nil {
 		return err
 	}
 
-	var newValue string = resp
-	records := strings.Split(resp, ",")
-	// Check that TTL is the same
-	if records[0] == value[0] {
-		// Check that we are not repeating our selves
-		var repeated bool = false
-		for i := range records {
-			if i == 0 {
-				continue
-			}
-			if records[i] == value[1] {
-				repeated = true
-				// If repeated replace the value at position i
-				records[i] = value[1]
-				break
+	cmps := make([]clientv3.Cmp, len(keys))
+	puts := make([]clientv3.Op, len(keys))
+	size := 0
+	for i, key := range keys {
+		var current []dns.RR
+		var revision int64
+		header := sets[key][0].Header()
+		if kvs := read.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+			revision = kvs[0].ModRevision
+			if !replace {
+				current, err = DecodeRRSet(header.Name, header.Rrtype, kvs[0].Value)
+				if err != nil {
+					return corrupt("Etcd", key, err)
+				}
 			}
 		}
-		if !repeated {
-			newValue = resp + "," + value[1]
-		} else {
-			newValue = strings.Join(records, ",")
+		for _, rr := range sets[key] {
+			current = mergeRRSet(current, rr)
+		}
+		value, err := EncodeRRSet(current)
+		if err != nil {
+			return err
 		}
-		// Take different TTLs as a complete update of the RR
-	} else {
-		newValue = strings.Join(value, ",")
+		// A key that doesn't exist has ModRevision 0
+		cmps[i] = clientv3.Compare(clientv3.ModRevision(key), "=", revision)
+		puts[i] = clientv3.OpPut(key, string(value))
+		size += 2*len(key) + len(value)
 	}
-	cli := edb.client
-	requestTimeout := edb.Timeout
-	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-	_, err = cli.Put(ctx, *key, newValue)
-	cancel()
+	if edb.MaxRequestBytes > 0 && size > edb.MaxRequestBytes {
+		return errTxnTooLarge
+	}
+
+	resp, err := edb.client.Txn(ctx).If(cmps...).Then(puts...).Commit()
 	if err != nil {
 		return err
 	}
+	if !resp.Succeeded {
+		return errTxnConflict
+	}
 	return nil
 }
 
 // MakeQuery : using a valid Etcd Client
 // makes a get query
 //
-// Records will be in format
-// DomainName:Type "TTL VALUES,TTL VALUES..."
-func (edb *EtcdDB) MakeQuery(m *dns.Msg) int {
+// Records are stored as DomainName:Type keys holding the encoded RRset
+func (edb *EtcdDB) MakeQuery(ctx context.Context, m *dns.Msg) error {
 
 	var dnsq dns.Question = m.Question[0]
+	key := dnsq.Name + ":" + dns.TypeToString[dnsq.Qtype]
 
-	switch dnsq.Qtype {
-	case dns.TypeA:
-		resp, err := edb.recoverKey(dnsq.Name + ":A")
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		}
-		if resp == "" {
-			// No value found
-			return 5 // Refused
-		}
-		records := strings.Split(resp, ",")
-		for i := range records {
-			values := strings.Split(records[i], " ")
-			ttl, _ := strconv.Atoi(values[0])
-			rr := &dns.A{
-				Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				A:   net.ParseIP(values[1]).To4(),
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeNS:
-		resp, err := edb.recoverKey(dnsq.Name + ":NS")
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		}
-		if resp == "" {
-			// No value found
-			return 5 // Refused
-		}
-		records := strings.Split(resp, ",")
-		for i := range records {
-			// TTL NSDNAME
-			values := strings.Split(records[i], " ")
-			ttl, _ := strconv.Atoi(values[0])
-			rr := &dns.NS{
-				Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				Ns:  values[1],
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeCNAME:
-		resp, err := edb.recoverKey(dnsq.Name + ":CNAME")
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		}
-		if resp == "" {
-			// No value found
-			return 5 // Refused
-		}
-		records := strings.Split(resp, ",")
-		for i := range records {
-			// TTL DOMAIN_NAME
-			values := strings.Split(records[i], " ")
-			ttl, _ := strconv.Atoi(values[0])
-			rr := &dns.CNAME{
-				Hdr:    dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				Target: values[1],
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeSOA:
-		resp, err := edb.recoverKey(dnsq.Name + ":SOA")
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		}
-		if resp == "" {
-			// No value found
-			return 5 // Refused
-		}
-		values := strings.Split(resp, " ")
-		// ttl mname rname serial refresh retry expire minimum
-		ttl, _ := strconv.Atoi(values[0])
-		serial, _ := strconv.Atoi(values[3])
-		refresh, _ := strconv.Atoi(values[4])
-		retry, _ := strconv.Atoi(values[5])
-		expire, _ := strconv.Atoi(values[6])
-		mintll, _ := strconv.Atoi(values[7])
-		rr := &dns.SOA{
-			Hdr:     dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(ttl)},
-			Ns:      values[1],
-			Mbox:    values[2],
-			Serial:  uint32(serial),
-			Refresh: uint32(refresh),
-			Retry:   uint32(retry),
-			Expire:  uint32(expire),
-			Minttl:  uint32(mintll)}
-		m.Answer = append(m.Answer, rr)
-	case dns.TypePTR:
-		resp, err := edb.recoverKey(dnsq.Name + ":PTR")
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		}
-		if resp == "" {
-			// No value found
-			return 5 // Refused
-		}
-		records := strings.Split(resp, ",")
-		for i := range records {
-			// TTL PTRDNAME
-			values := strings.Split(records[i], " ")
-			ttl, _ := strconv.Atoi(values[0])
-			rr := &dns.PTR{
-				Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				Ptr: values[1],
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeHINFO:
-		resp, err := edb.recoverKey(dnsq.Name + ":HINFO")
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		}
-		if resp == "" {
-			// No value found
-			return 5 // Refused
-		}
-		records := strings.Split(resp, ",")
-		for i := range records {
-			// TTL CPU OS
-			values := strings.Split(records[i], " ")
-			ttl, _ := strconv.Atoi(values[0])
-			rr := &dns.HINFO{
-				Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				Cpu: values[1],
-				Os:  values[2],
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeMX:
-		resp, err := edb.recoverKey(dnsq.Name + ":MX")
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		}
-		if resp == "" {
-			// No value found
-			return 5 // Refused
-		}
-		records := strings.Split(resp, ",")
-		for i := range records {
-			// TTL preference exchange
-			values := strings.Split(records[i], " ")
-			ttl, _ := strconv.Atoi(values[0])
-			preference, _ := strconv.Atoi(values[1])
-			rr := &dns.MX{
-				Hdr:        dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				Preference: uint16(preference),
-				Mx:         values[2],
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeTXT:
-		resp, err := edb.recoverKey(dnsq.Name + ":TXT")
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		}
-		// TTL val1 val2 val3 ...
-		if resp == "" {
-			// No value found
-			return 5 // Refused
-		}
-		records := strings.Split(resp, ",")
-		ttl, _ := strconv.Atoi(records[0])
-		rr := &dns.TXT{
-			Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(ttl)},
-			Txt: records[1:],
-		}
-		m.Answer = append(m.Answer, rr)
+	resp, err := edb.recoverKey(ctx, key)
+	if err != nil {
+		return backendError(ctx, "Etcd", err)
 	}
+	if resp == "" {
+		return ErrNotFound
+	}
+	rrs, err := DecodeRRSet(dnsq.Name, dnsq.Qtype, []byte(resp))
+	if err != nil {
+		return corrupt("Etcd", key, err)
+	}
+	m.Answer = append(m.Answer, rrs...)
 
 	if len(m.Answer) >= 1 {
-		return 0 // No error
+		return nil
 	}
-	return 3 // Domain name does not exists
+	return ErrNotFound
 }
 
-// UploadRR to Etcd Cluster from line appending it to the end of the value
-func (edb *EtcdDB) UploadRR(line string) error {
-
-	tk := strings.Split(line, "\t")
-	var dnsType string = tk[3]
-
-	switch dnsType {
-	case "A":
-		var key string = tk[0] + ":A"
-		var newRR string = tk[1] + " " + tk[4]
-
-		err := edb.putValueOnSet(&key, &newRR)
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return err
-		}
-	case "NS":
-		var key string = tk[0] + ":NS"
-		var newRR string = tk[1] + " " + tk[4]
-
-		err := edb.putValueOnSet(&key, &newRR)
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return err
-		}
-	case "CNAME":
-		var key string = tk[0] + ":CNAME"
-		var newRR string = tk[1] + " " + tk[4]
-
-		err := edb.putValueOnSet(&key, &newRR)
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return err
-		}
-	case "SOA":
-		var key string = tk[0] + ":SOA"
-		newValue := tk[1] + " " + tk[4]
-		cli := edb.client
-		requestTimeout := edb.Timeout
-		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-		_, err := cli.Put(ctx, key, newValue)
-		cancel()
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return err
-		}
-	case "PRT":
-		// Check that domain name is in-addr.arpa compliant
-		// Just in case the record was added as an IP and answer
-		var domain string = tk[0]
-		if strings.Contains(domain, "in-addr.arpa") {
-			domain, _ = dns.ReverseAddr(domain)
-		}
-		var key string = domain + ":PTR"
-		newValue := tk[1] + " " + tk[4]
-		cli := edb.client
-		requestTimeout := edb.Timeout
-		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-		_, err := cli.Put(ctx, key, newValue)
-		cancel()
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return err
-		}
-	case "HINFO":
-		var key string = tk[0] + ":HINFO"
-		var newRR string = tk[1] + " " + tk[4]
-
-		err := edb.putValueOnSet(&key, &newRR)
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return err
-		}
-	case "MX":
-		var key string = tk[0] + ":MX"
-		var newRR string = tk[1] + " " + tk[4]
-
-		err := edb.putValueOnSet(&key, &newRR)
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return err
-		}
-	case "TXT":
-		var key string = tk[0] + ":TXT"
-		var newRR []string = []string{tk[1], strings.ReplaceAll(tk[4], "\"", "")}
-
-		err := edb.putTXTOnList(&key, newRR)
-		if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return err
-		}
+// UploadRR to Etcd Cluster from line adding it to its RRset
+func (edb *EtcdDB) UploadRR(ctx context.Context, line string) error {
+	rr, err := ParseRecord(line)
+	if err != nil {
+		log.Printf("Error parsing %s: %v", line, err)
+		return err
+	}
+	if err := edb.putRR(ctx, rr); err != nil {
+		log.Printf("Error on Etcd %v", err)
+		return err
 	}
 	return nil
 }
 
-// HandleFile reads a file containing RRs a uploads them replacing if set
-func (edb *EtcdDB) HandleFile(location string, replace bool) {
-	log.Println("Not implemented")
-	return
+// UploadBatch : adds the records to their RRsets in transactions of
+// several puts, stopping at the first one that fails
+func (edb *EtcdDB) UploadBatch(ctx context.Context, rrs []dns.RR) error {
+	return edb.putRRs(ctx, rrs, false)
 }
 
-// Handle : function to call on the dns server when a package is received.
-// Prepares the package and calls Etcd to fill it up
-func (edb *EtcdDB) Handle(w dns.ResponseWriter, r *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-
-	if edb.Print {
-		logQuery(r)
+// HandleFile reads a file containing RRs a uploads them replacing if set
+func (edb *EtcdDB) HandleFile(ctx context.Context, location string, replace bool) {
+	rrs, err := utils.ReadAndParseZoneFile(location, "")
+	if err != nil {
+		log.Printf("Error reading %s: %v", location, err)
+		return
+	}
+	if err := edb.putRRs(ctx, rrs, replace); err != nil {
+		log.Printf("Error on Etcd uploading %s: %v", location, err)
+		return
 	}
+	log.Printf("Uploaded %d records from %s", len(rrs), location)
+}
 
-	if r.MsgHdr.Authoritative {
-		m.Rcode = 4 // Not implemented
-		w.WriteMsg(m)
-	} else {
-		rcode := edb.MakeQuery(m)
-		m.Rcode = rcode
-		w.WriteMsg(m)
+// WatchChanges : watches the whole key space evicting the changed RRsets.
+// The watch resumes from the last seen revision, or from the compaction
+// revision when that one is gone, expiring the cache when events may have
+// been missed.
+func (edb *EtcdDB) WatchChanges(ctx context.Context, cache *Cache) {
+	var revision int64
+	for ctx.Err() == nil {
+		opts := []clientv3.OpOption{clientv3.WithPrefix()}
+		if revision > 0 {
+			opts = append(opts, clientv3.WithRev(revision+1))
+		}
+		// Without a leader the watch would silently stop receiving events
+		watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		for resp := range edb.client.Watch(watchCtx, "", opts...) {
+			if resp.CompactRevision != 0 {
+				log.Printf("Etcd watch compacted at revision %d, expiring cache", resp.CompactRevision)
+				cache.Expire()
+				revision = resp.CompactRevision - 1
+				break
+			}
+			if err := resp.Err(); err != nil {
+				log.Printf("Etcd watch failed: %v", err)
+				break
+			}
+			for _, ev := range resp.Events {
+				cache.EvictKey(string(ev.Kv.Key))
+			}
+			revision = resp.Header.Revision
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		// Whatever changed while the watch was down is unknown
+		cache.Expire()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
 	}
 }
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ServeHealth : serves /healthz and /readyz over HTTP on addr.
+// /healthz answers while the process is up. /readyz pings the database
+// and reports not ready when the ping fails, takes longer than budget
+// or the server is shutting down.
+func (s *Server) ServeHealth(addr string, budget time.Duration) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.ready(r.Context(), budget); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	s.health = &http.Server{Addr: addr, Handler: mux}
+	log.Printf("Serving health checks on %s\n", addr)
+	go func() {
+		if err := s.health.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.errors <- fmt.Errorf("health server on %s: %v", addr, err)
+		}
+	}()
+}
+
+// ready pings the driver within the latency budget. Drivers that don't
+// honor the context are abandoned once the budget is spent
+func (s *Server) ready(ctx context.Context, budget time.Duration) error {
+	if atomic.LoadInt32(&s.stopping) == 1 {
+		return fmt.Errorf("shutting down")
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Driver.Ping(ctx)
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("database ping failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > budget {
+			return fmt.Errorf("database ping took %v, budget is %v", elapsed, budget)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("database ping exceeded %v: %v", budget, ctx.Err())
+	}
+}
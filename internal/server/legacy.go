@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-redis/redis"
+	"github.com/miekg/dns"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// The first releases stored each record as "TTL RDATA", with the RDATA of
+// the zone file line and the TXT strings without their quotes, on the
+// same name:TYPE keys:
+//
+//	etcd:  the records joined by commas, TXT as "TTL,text,text"
+//	Redis: SOA and PTR as strings, TXT as a list and the other types as
+//	       sets of records
+//
+// DecodeRRSet reads the etcd and Redis string values as version 0 so a
+// deployment keeps answering while the Migrate of its driver rewrites
+// them with EncodeRRSet. The Redis sets and lists can only be read once
+// converted.
+
+// decodeLegacy : records of name and type from their version 0 form
+func decodeLegacy(name string, rrtype uint16, data []byte) ([]dns.RR, error) {
+	values := strings.Split(string(data), ",")
+	if rrtype == dns.TypeTXT {
+		if len(values) < 2 {
+			return nil, fmt.Errorf("bad version 0 record %q", data)
+		}
+		ttl := values[0]
+		rrs := make([]dns.RR, 0, len(values)-1)
+		for _, text := range values[1:] {
+			rr, err := legacyRecord(name, rrtype, ttl+" "+text)
+			if err != nil {
+				return nil, err
+			}
+			rrs = append(rrs, rr)
+		}
+		return rrs, nil
+	}
+
+	rrs := make([]dns.RR, 0, len(values))
+	for _, value := range values {
+		rr, err := legacyRecord(name, rrtype, value)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// legacyRecord : record of name and type from its "TTL RDATA" form
+func legacyRecord(name string, rrtype uint16, value string) (dns.RR, error) {
+	fields := strings.SplitN(strings.TrimSpace(value), " ", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("bad version 0 record %q", value)
+	}
+	ttl, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad TTL of version 0 record %q", value)
+	}
+	hdr := dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype, Class: dns.ClassINET, Ttl: uint32(ttl)}
+	if rrtype == dns.TypeTXT {
+		return &dns.TXT{Hdr: hdr, Txt: []string{fields[1]}}, nil
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, ttl, dns.TypeToString[rrtype], fields[1]))
+	if err != nil {
+		return nil, fmt.Errorf("bad version 0 record %q: %v", value, err)
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty version 0 record %q", value)
+	}
+	return rr, nil
+}
+
+// legacyKey : name and type of a name:TYPE key, false for other keys
+func legacyKey(key string) (string, uint16, bool) {
+	i := strings.LastIndex(key, ":")
+	if i <= 0 {
+		return "", 0, false
+	}
+	rrtype, ok := dns.StringToType[key[i+1:]]
+	return key[:i], rrtype, ok
+}
+
+// isLegacy tells if data isn't in the JSON encoding of EncodeRRSet
+func isLegacy(data []byte) bool {
+	return len(data) > 0 && data[0] != '{'
+}
+
+// Migrate : rewrites the version 0 records of the cluster with the
+// current encoding. A record changed meanwhile is left for the next run
+func (edb *EtcdDB) Migrate(ips []string) error {
+	edb.ConnectDB(ips)
+	defer edb.Disconnect()
+	ctx := context.Background()
+
+	converted := 0
+	from := "\x00"
+	for {
+		getCtx, cancel := context.WithTimeout(ctx, edb.Timeout)
+		resp, err := edb.client.Get(getCtx, from, clientv3.WithFromKey(), clientv3.WithLimit(1000))
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			name, rrtype, ok := legacyKey(string(kv.Key))
+			if !ok || !isLegacy(kv.Value) {
+				continue
+			}
+			rrs, err := decodeLegacy(name, rrtype, kv.Value)
+			if err != nil {
+				log.Printf("Skipping etcd record %s: %v", kv.Key, err)
+				continue
+			}
+			value, err := EncodeRRSet(rrs)
+			if err != nil {
+				return err
+			}
+			putCtx, cancel := context.WithTimeout(ctx, edb.Timeout)
+			txn, err := edb.client.Txn(putCtx).
+				If(clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+				Then(clientv3.OpPut(string(kv.Key), string(value))).Commit()
+			cancel()
+			if err != nil {
+				return fmt.Errorf("converting %s: %v", kv.Key, err)
+			}
+			if txn.Succeeded {
+				converted++
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		from = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+	log.Printf("Converted %d etcd records to encoding version %d", converted, EncodingVersion)
+	return nil
+}
+
+// Migrate : rewrites the version 0 records of every master with the
+// current encoding, on the hashes of the names with the hashes model
+func (r *RedisKVS) Migrate(ips []string) error {
+	r.ConnectDB(ips)
+	defer r.Disconnect()
+	ctx := context.Background()
+
+	var converted int64
+	err := r.client.ForEachMaster(func(master *redis.Client) error {
+		var cursor uint64
+		for {
+			keys, next, err := master.Scan(cursor, "*:*", 1000).Result()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				ok, err := r.convertKey(ctx, master, key)
+				if err != nil {
+					return fmt.Errorf("converting %s: %v", key, err)
+				}
+				if ok {
+					atomic.AddInt64(&converted, 1)
+				}
+			}
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Converted %d redis records to encoding version %d", converted, EncodingVersion)
+	return nil
+}
+
+// convertKey rewrites the version 0 RRset on key, telling if it did
+func (r *RedisKVS) convertKey(ctx context.Context, master *redis.Client, key string) (bool, error) {
+	name, rrtype, ok := legacyKey(key)
+	if !ok {
+		return false, nil
+	}
+
+	var rrs []dns.RR
+	convert := func(tx *redis.Tx) error {
+		kind, err := tx.Type(key).Result()
+		if err != nil {
+			return err
+		}
+		var values []string
+		switch kind {
+		case "set":
+			values, err = tx.SMembers(key).Result()
+		case "list":
+			values, err = tx.LRange(key, 0, -1).Result()
+		case "string":
+			value, err := tx.Get(key).Bytes()
+			if err != nil || !isLegacy(value) {
+				return err
+			}
+			if rrs, err = decodeLegacy(name, rrtype, value); err != nil {
+				log.Printf("Skipping redis record %s: %v", key, err)
+				rrs = nil
+				return nil
+			}
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			rr, err := legacyRecord(name, rrtype, value)
+			if err != nil {
+				log.Printf("Skipping redis record %s %q: %v", key, value, err)
+				continue
+			}
+			rrs = append(rrs, rr)
+		}
+		if len(rrs) == 0 {
+			return nil
+		}
+
+		if r.Model == RedisHashesModel {
+			// The hash is written first so the records are never missing
+			if err := r.UploadBatch(ctx, rrs); err != nil {
+				return err
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Del(key)
+				return nil
+			})
+			return err
+		}
+		value, err := EncodeRRSet(rrs)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(key)
+			pipe.Set(key, value, 0)
+			return nil
+		})
+		return err
+	}
+
+	for {
+		rrs = nil
+		err := master.WithContext(ctx).Watch(convert, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return err == nil && len(rrs) > 0, err
+	}
+}
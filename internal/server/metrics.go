@@ -0,0 +1,31 @@
+package server
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// Counters published on /debug/vars
+var (
+	rrlDropped = expvar.NewInt("rrl_dropped")
+	rrlSlipped = expvar.NewInt("rrl_slipped")
+
+	cacheHits      = expvar.NewInt("cache_hits")
+	cacheMisses    = expvar.NewInt("cache_misses")
+	cacheEvictions = expvar.NewInt("cache_evictions")
+	cacheStale     = expvar.NewInt("cache_stale_answers")
+
+	backendTimeouts = expvar.NewInt("backend_timeouts")
+	backendErrors   = expvar.NewInt("backend_errors")
+)
+
+// ServeMetrics : exposes the expvar counters over HTTP on addr
+func ServeMetrics(addr string) {
+	log.Printf("Serving metrics on %s/debug/vars\n", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/miekg/dns"
+)
+
+// Migrator : drivers that create and upgrade their own schema, or convert
+// the records stored by earlier releases
+type Migrator interface {
+	Migrate(ips []string) error
+}
+
+// cassandraMigration : schema change applied once and recorded with its
+// version on the schema_migrations table of the keyspace
+type cassandraMigration struct {
+	version     int
+	description string
+	// Statements run in order, %[1]s is replaced by the keyspace
+	statements []string
+	// Copies the data once the statements ran, nil for schema changes
+	copy func(c *CassandraDB, ctx context.Context, session *gocql.Session) error
+}
+
+// cassandraMigrations must only be appended to, released migrations may
+// have been applied already
+var cassandraMigrations = []cassandraMigration{
+	{
+		version:     1,
+		description: "records table keyed by name, type and data",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s.domain_records (
+				domain_name text,
+				type text,
+				rdata text,
+				rrset blob,
+				PRIMARY KEY ((domain_name, type), rdata)
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "records table partitioned by zone",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s.zone_records (
+				zone text,
+				name text,
+				type text,
+				rdata text,
+				rrset blob,
+				PRIMARY KEY ((zone), name, type, rdata)
+			)`,
+		},
+	},
+	{
+		version:     3,
+		description: "records of the per type tables copied to domain_records",
+		copy:        (*CassandraDB).copyLegacyTables,
+	},
+}
+
+// Migrate : creates the keyspace with the Replication options when it
+// doesn't exist and applies the migrations it is missing
+func (c *CassandraDB) Migrate(ips []string) error {
+	session, err := c.newCluster(ips, "").CreateSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	ctx := context.Background()
+
+	statements := []string{
+		fmt.Sprintf(`CREATE KEYSPACE IF NOT EXISTS %s WITH replication = %s`, c.Keyspace, replicationMap(c.Replication)),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.schema_migrations (
+			version int PRIMARY KEY,
+			description text,
+			applied_at timestamp
+		)`, c.Keyspace),
+	}
+	for _, stmt := range statements {
+		if err := c.schemaChange(ctx, session, stmt); err != nil {
+			return err
+		}
+	}
+
+	applied := make(map[int]bool)
+	var version int
+	iter := session.Query(fmt.Sprintf(`SELECT version FROM %s.schema_migrations`, c.Keyspace)).
+		Consistency(gocql.Quorum).Iter()
+	for iter.Scan(&version) {
+		applied[version] = true
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for _, migration := range cassandraMigrations {
+		if applied[migration.version] {
+			continue
+		}
+		log.Printf("Applying Cassandra migration %d: %s", migration.version, migration.description)
+		for _, stmt := range migration.statements {
+			if err := c.schemaChange(ctx, session, fmt.Sprintf(stmt, c.Keyspace)); err != nil {
+				return fmt.Errorf("migration %d: %v", migration.version, err)
+			}
+		}
+		if migration.copy != nil {
+			if err := migration.copy(c, ctx, session); err != nil {
+				return fmt.Errorf("migration %d: %v", migration.version, err)
+			}
+		}
+		err := session.Query(fmt.Sprintf(`INSERT INTO %s.schema_migrations (version, description, applied_at) VALUES (?, ?, ?) IF NOT EXISTS`,
+			c.Keyspace), migration.version, migration.description, time.Now()).Consistency(gocql.Quorum).Exec()
+		if err != nil {
+			return fmt.Errorf("recording migration %d: %v", migration.version, err)
+		}
+	}
+	log.Printf("Cassandra keyspace %s is at schema version %d", c.Keyspace, cassandraMigrations[len(cassandraMigrations)-1].version)
+	return nil
+}
+
+// schemaChange runs a DDL statement and waits until every node has the
+// new schema
+func (c *CassandraDB) schemaChange(ctx context.Context, session *gocql.Session, stmt string) error {
+	if err := session.Query(stmt).Exec(); err != nil {
+		return err
+	}
+	return session.AwaitSchemaAgreement(ctx)
+}
+
+// replicationMap : CQL map of the replication options
+func replicationMap(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]string, len(keys))
+	for i, key := range keys {
+		entries[i] = fmt.Sprintf("'%s': '%s'", key, options[key])
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+// legacyTables : tables of the first releases, a row per record with the
+// RDATA fields in columns
+var legacyTables = []struct {
+	table   string
+	rrtype  uint16
+	columns []string
+}{
+	{"domain_a", dns.TypeA, []string{"address"}},
+	{"domain_ns", dns.TypeNS, []string{"nsdname"}},
+	{"domain_cname", dns.TypeCNAME, []string{"domain_cname"}},
+	{"domain_soa", dns.TypeSOA, []string{"mname", "rname", "serial", "refresh", "retry", "expire", "minimum"}},
+	{"domain_ptr", dns.TypePTR, []string{"ptrdname"}},
+	{"domain_hinfo", dns.TypeHINFO, []string{"cpu", "os"}},
+	{"domain_mx", dns.TypeMX, []string{"preference", "exchange"}},
+	{"domain_txt", dns.TypeTXT, []string{"txt"}},
+}
+
+// copyLegacyTables copies the records of the tables of the first
+// releases found on the keyspace to domain_records. The tables are left
+// in place to be dropped once the copy is checked
+func (c *CassandraDB) copyLegacyTables(ctx context.Context, session *gocql.Session) error {
+	existing := make(map[string]bool)
+	var table string
+	iter := session.Query(`SELECT table_name FROM system_schema.tables WHERE keyspace_name = ?`, c.Keyspace).
+		WithContext(ctx).Iter()
+	for iter.Scan(&table) {
+		existing[table] = true
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	insert := fmt.Sprintf(`INSERT INTO %s.domain_records (domain_name, type, rdata, rrset) VALUES (?, ?, ?, ?)`, c.Keyspace)
+	for _, legacy := range legacyTables {
+		if !existing[legacy.table] {
+			continue
+		}
+		copied, skipped := 0, 0
+		iter := session.Query(fmt.Sprintf(`SELECT domain_name, ttl, %s FROM %s.%s`,
+			strings.Join(legacy.columns, ", "), c.Keyspace, legacy.table)).
+			WithContext(ctx).Consistency(gocql.Quorum).PageSize(1000).Iter()
+		for row := make(map[string]interface{}); iter.MapScan(row); row = make(map[string]interface{}) {
+			fields := make([]string, len(legacy.columns))
+			for i, column := range legacy.columns {
+				fields[i] = fmt.Sprint(row[column])
+			}
+			name, _ := row["domain_name"].(string)
+			rr, err := legacyRecord(name, legacy.rrtype, fmt.Sprintf("%v %s", row["ttl"], strings.Join(fields, " ")))
+			if err != nil {
+				log.Printf("Skipping %s record of %s: %v", legacy.table, name, err)
+				skipped++
+				continue
+			}
+			rrset, err := EncodeRRSet([]dns.RR{rr})
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			args := []interface{}{rr.Header().Name, dns.TypeToString[legacy.rrtype], rdata(rr), rrset}
+			err = c.write(ctx, func() error {
+				return session.Query(insert, args...).WithContext(ctx).Consistency(gocql.Quorum).Exec()
+			})
+			if err != nil {
+				iter.Close()
+				return fmt.Errorf("copying %s record of %s: %v", legacy.table, name, err)
+			}
+			copied++
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		log.Printf("Copied %d records of %s to domain_records, %d skipped", copied, legacy.table, skipped)
+	}
+	return nil
+}
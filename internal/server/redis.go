@@ -1,311 +1,340 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
-	"net"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/miekg/dns"
 )
 
+// Data models of the Redis driver
+const (
+	// RedisKeysModel : a string key per name and type
+	RedisKeysModel = "keys"
+	// RedisHashesModel : a hash per name with a field per type, tagged
+	// with the zone so the names of a zone share a cluster slot
+	RedisHashesModel = "hashes"
+)
+
 // RedisKVS : Implements DBDriver and holds the redis cluster client
 type RedisKVS struct {
-	client *redis.ClusterClient
-	Print  bool
+	client       *redis.ClusterClient
+	Print        bool
+	PoolSize     int
+	MaxRedirects int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Data model of the records, RedisKeysModel by default
+	Model string
+	// Commands sent in each pipeline by UploadBatch, 0 sends one pipeline
+	PipelineSize int
+	// Deployment, RedisClusterMode by default, and primary name of the
+	// sentinel mode
+	Mode       string
+	MasterName string
+	// Send the reads to the replicas, to the closest one when
+	// RouteByLatency is set and to a random one otherwise
+	ReadFromReplicas bool
+	RouteByLatency   bool
+	// AUTH password, as Username for an ACL user, and client TLS when
+	// TLSConfig isn't nil
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+	// Replicas taking the reads outside cluster mode
+	replicas *replicaSet
+	// Stops following the sentinels and probing the replicas
+	cancel context.CancelFunc
+	zones  atomic.Value // []string
 }
 
 // MakeQuery : using a valid Redis client
 // makes a get query
-func (r *RedisKVS) MakeQuery(m *dns.Msg) int {
-	var dnsq dns.Question = m.Question[0]
-	rclient := r.client
-	switch dnsq.Qtype {
-	case dns.TypeA:
-
-		rrVal, err := rclient.SMembers(dnsq.Name + ":A").Result()
-		if err == redis.Nil {
-			fmt.Println("no value found")
-		} else if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		} else {
-			for i := range rrVal {
-				// TTL ADDRESS
-				values := strings.Split(rrVal[i], " ")
-				ttl, _ := strconv.Atoi(values[0])
-				rr := &dns.A{
-					Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(ttl)},
-					A:   net.ParseIP(values[1]).To4(),
-				}
-				m.Answer = append(m.Answer, rr)
-			}
-		}
-
-	case dns.TypeNS:
-
-		rrVal, err := rclient.SMembers(dnsq.Name + ":NS").Result()
-		if err == redis.Nil {
-			fmt.Println("no value found")
-		} else if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		} else {
-			for i := range rrVal {
-				// TTL NSDNAME
-				values := strings.Split(rrVal[i], " ")
-				ttl, _ := strconv.Atoi(values[0])
-				rr := &dns.NS{
-					Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(ttl)},
-					Ns:  values[1],
-				}
-				m.Answer = append(m.Answer, rr)
-			}
-		}
-	case dns.TypeCNAME:
-
-		rrVal, err := rclient.SMembers(dnsq.Name + ":CNAME").Result()
-		if err == redis.Nil {
-			fmt.Println("no value found")
-		} else if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		} else {
-			for i := range rrVal {
-				// TTL DOMAIN_NAME
-				values := strings.Split(rrVal[i], " ")
-				ttl, _ := strconv.Atoi(values[0])
-				rr := &dns.CNAME{
-					Hdr:    dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: uint32(ttl)},
-					Target: values[1],
-				}
-				m.Answer = append(m.Answer, rr)
-			}
-		}
-	case dns.TypeSOA:
-
-		rrVal, err := rclient.Get(dnsq.Name + ":SOA").Result()
-		if err == redis.Nil {
-			fmt.Println("no value found")
-		} else if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		} else {
-			// ttl mname rname serial refresh retry expire minimum
-			values := strings.Split(rrVal, " ")
-			ttl, _ := strconv.Atoi(values[0])
-			serial, _ := strconv.Atoi(values[3])
-			refresh, _ := strconv.Atoi(values[4])
-			retry, _ := strconv.Atoi(values[5])
-			expire, _ := strconv.Atoi(values[6])
-			mintll, _ := strconv.Atoi(values[7])
-			rr := &dns.SOA{
-				Hdr:     dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				Ns:      values[1],
-				Mbox:    values[2],
-				Serial:  uint32(serial),
-				Refresh: uint32(refresh),
-				Retry:   uint32(retry),
-				Expire:  uint32(expire),
-				Minttl:  uint32(mintll)}
-			m.Answer = append(m.Answer, rr)
-		}
-
-	case dns.TypePTR:
-
-		rrVal, err := rclient.Get(dnsq.Name + ":PTR").Result()
-		if err == redis.Nil {
-			fmt.Println("no value found")
-		} else if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		} else {
-			// TTL PTRDNAME
-			values := strings.Split(rrVal, " ")
-			ttl, _ := strconv.Atoi(values[0])
-			rr := &dns.PTR{
-				Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				Ptr: values[1],
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeHINFO:
-
-		rrVal, err := rclient.SMembers(dnsq.Name + ":HINFO").Result()
-		if err == redis.Nil {
-			fmt.Println("no value found")
-		} else if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		} else {
-			for i := range rrVal {
-				// TTL CPU OS
-				values := strings.Split(rrVal[i], " ")
-				ttl, _ := strconv.Atoi(values[0])
-				rr := &dns.HINFO{
-					Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: uint32(ttl)},
-					Cpu: values[1],
-					Os:  values[2],
-				}
-				m.Answer = append(m.Answer, rr)
-			}
-		}
+//
+// Records are stored as DomainName:Type keys holding the encoded RRset
+func (r *RedisKVS) MakeQuery(ctx context.Context, m *dns.Msg) error {
+	if r.Model == RedisHashesModel {
+		return r.queryHash(ctx, m)
+	}
 
-	case dns.TypeMX:
+	var dnsq dns.Question = m.Question[0]
+	key := dnsq.Name + ":" + dns.TypeToString[dnsq.Qtype]
 
-		rrVal, err := rclient.SMembers(dnsq.Name + ":MX").Result()
-		if err == redis.Nil {
-			fmt.Println("no value found")
-		} else if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		} else {
-			for i := range rrVal {
-				// TTL preference exchange
-				values := strings.Split(rrVal[i], " ")
-				ttl, _ := strconv.Atoi(values[0])
-				preference, _ := strconv.Atoi(values[1])
-				rr := &dns.MX{
-					Hdr:        dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: uint32(ttl)},
-					Preference: uint16(preference),
-					Mx:         values[2],
-				}
-				m.Answer = append(m.Answer, rr)
-			}
-		}
-	case dns.TypeTXT:
-		// TTL val1 val2 val3 ...
-		rrVal, err := rclient.LRange(dnsq.Name+":TXT", 0, -1).Result()
-		if err == redis.Nil {
-			fmt.Println("no value found")
-		} else if err != nil {
-			log.Printf("Error on Etcd %v", err)
-			return 2 // Server Problem
-		} else {
-			ttl, _ := strconv.Atoi(rrVal[0])
-			rr := &dns.TXT{
-				Hdr: dns.RR_Header{Name: dnsq.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(ttl)},
-				Txt: rrVal[1:],
-			}
-			m.Answer = append(m.Answer, rr)
-		}
+	var value []byte
+	err := r.read(ctx, func(rclient redis.Cmdable) (err error) {
+		value, err = rclient.Get(key).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return ErrNotFound
+	} else if err != nil {
+		return backendError(ctx, "Redis", err)
+	}
+	rrs, err := DecodeRRSet(dnsq.Name, dnsq.Qtype, value)
+	if err != nil {
+		return corrupt("Redis", key, err)
 	}
+	m.Answer = append(m.Answer, rrs...)
 
 	if len(m.Answer) >= 1 {
-		return 0 // No error
+		return nil
 	}
-	return 3 // Domain name does not exists
+	return ErrNotFound
 }
 
-// UploadRR to Cassandra Cluster from line
-func (r *RedisKVS) UploadRR(line string) error {
-
-	// Capture tokens
-	tk := strings.Split(line, "\t")
-	var dnsType string = tk[3]
-
-	rclient := r.client
-	switch dnsType {
-	case "A":
-		_, err := rclient.SAdd(tk[0]+":A", tk[1]+" "+tk[4]).Result()
-		if err != nil {
-			log.Printf("Error at redis uploading %s: %v", tk[0], err)
-			return err
-		}
-	case "NS":
-		_, err := rclient.SAdd(tk[0]+":NS", tk[1]+" "+tk[4]).Result()
-		if err != nil {
-			log.Printf("Error at redis uploading %s: %v", tk[0], err)
+// read runs the reads of fn on a replica outside cluster mode, or on the
+// cluster client. A replica that fails is left out until it's probed
+// again and the reads made on the primary instead
+func (r *RedisKVS) read(ctx context.Context, fn func(redis.Cmdable) error) error {
+	if replica := r.replicas.pick(); replica != nil {
+		err := fn(replica.WithContext(ctx))
+		if err == nil || err == redis.Nil || ctx.Err() != nil {
 			return err
 		}
-	case "CNAME":
-		_, err := rclient.SAdd(tk[0]+":CNAME", tk[1]+" "+tk[4]).Result()
-		if err != nil {
-			log.Printf("Error at redis uploading %s: %v", tk[0], err)
-			return err
-		}
-	case "SOA":
-		_, err := rclient.Set(tk[0]+":SOA", tk[1]+" "+tk[4], 0).Result()
-		if err != nil {
-			log.Printf("Error at redis uploading %s: %v", tk[0], err)
-			return err
-		}
-	case "PTR":
+		log.Printf("Error reading from redis replica %s, reading from the primary: %v", replica.Options().Addr, err)
+		r.replicas.markDown(replica)
+	}
+	return fn(r.client.WithContext(ctx))
+}
 
-		// Check that domain name is in-addr.arpa compliant
-		// Just in case the record was added as an IP and answer
-		var domain string = tk[0]
-		if strings.Contains(domain, "in-addr.arpa") {
-			domain, _ = dns.ReverseAddr(domain)
-		}
-		_, err := rclient.Set(domain+":PTR", tk[1]+" "+tk[4], 0).Result()
-		if err != nil {
-			log.Printf("Error at redis uploading %s: %v", tk[0], err)
-			return err
-		}
-	case "HINFO":
-		_, err := rclient.SAdd(tk[0]+":HINFO", tk[1]+" "+tk[4]).Result()
-		if err != nil {
-			log.Printf("Error at redis uploading %s: %v", tk[0], err)
+// UploadRR to Redis Cluster from line, adding the record to its RRset.
+// The RRset is rewritten in a transaction that is retried when another
+// client changes it meanwhile
+func (r *RedisKVS) UploadRR(ctx context.Context, line string) error {
+	rr, err := ParseRecord(line)
+	if err != nil {
+		log.Printf("Error parsing %s: %v", line, err)
+		return err
+	}
+	if r.Model == RedisHashesModel {
+		return r.uploadHash(ctx, rr)
+	}
+	key := recordKey(rr)
+	rclient := r.client.WithContext(ctx)
+
+	update := func(tx *redis.Tx) error {
+		var rrs []dns.RR
+		value, err := tx.Get(key).Bytes()
+		if err == nil {
+			rrs, err = DecodeRRSet(rr.Header().Name, rr.Header().Rrtype, value)
+			if err != nil {
+				return corrupt("Redis", key, err)
+			}
+		} else if err != redis.Nil {
 			return err
 		}
-	case "MX":
-		_, err := rclient.SAdd(tk[0]+":MX", tk[1]+" "+tk[4]).Result()
+		value, err = EncodeRRSet(mergeRRSet(rrs, rr))
 		if err != nil {
-			log.Printf("Error at redis uploading %s: %v", tk[0], err)
 			return err
 		}
-	case "TXT":
-		_, err := rclient.RPush(tk[0]+":TXT", tk[1]+" "+strings.ReplaceAll(tk[4], "\"", "")).Result()
-		if err != nil {
-			log.Printf("Error at redis uploading %s: %v", tk[0], err)
-			return err
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, value, 0)
+			return nil
+		})
+		return err
+	}
+
+	for {
+		err = rclient.Watch(update, key)
+		if err != redis.TxFailedErr || ctx.Err() != nil {
+			break
 		}
 	}
+	if err != nil {
+		log.Printf("Error at redis uploading %s: %v", key, err)
+		return err
+	}
 	return nil
 }
 
 // HandleFile reads a file containing RRs a uploads them replacing if set
-func (r *RedisKVS) HandleFile(location string, replace bool) {
+func (r *RedisKVS) HandleFile(ctx context.Context, location string, replace bool) {
 	log.Println("Not implemented")
 	return
 }
 
+// Ping : pings every master of the cluster
+func (r *RedisKVS) Ping(ctx context.Context) error {
+	return r.client.WithContext(ctx).ForEachMaster(func(master *redis.Client) error {
+		return master.WithContext(ctx).Ping().Err()
+	})
+}
+
 // Disconnect : Closes the Redis client
 func (r *RedisKVS) Disconnect() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.replicas.close()
 	err := r.client.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// ConnectDB : assign redis cluster client given the IPs and ports
+// ConnectDB : assign redis client given the IPs and ports of the nodes
+// or sentinels of the Mode
 func (r *RedisKVS) ConnectDB(ips []string) {
 	// []string{":7000", ":7001", ":7002", ":7003", ":7004", ":7005"}
-	rdb := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs: ips,
+	if r.Mode == RedisClusterMode || r.Mode == "" {
+		r.client = redis.NewClusterClient(r.clusterOptions(ips))
+		return
+	}
+	if r.ReadFromReplicas {
+		r.replicas = newReplicaSet(r.nodeOptions, r.RouteByLatency)
+	}
+	r.client = redis.NewClusterClient(r.clusterOptions(ips))
+	if r.Mode == RedisStandaloneMode {
+		r.replicas.update(ips[1:])
+	}
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(context.Background())
+	go r.followNodes(ctx)
+}
+
+// WatchChanges : subscribes to the keyspace notifications of every master
+// evicting the changed RRsets. The subscriptions are made again, and the
+// cache expired, when the masters of the cluster change. When the cluster
+// doesn't send notifications the cache relies on the TTLs alone.
+func (r *RedisKVS) WatchChanges(ctx context.Context, cache *Cache) {
+	for ctx.Err() == nil {
+		masters, err := r.masters()
+		if err != nil {
+			log.Printf("Error listing redis masters: %v", err)
+		} else {
+			for addr, master := range masters {
+				if err := keyspaceEvents(master, r.Model); err != nil {
+					log.Printf("Warning: redis %s doesn't send keyspace notifications, "+
+						"cached records will only expire by TTL: %v", addr, err)
+					return
+				}
+			}
+			subCtx, cancel := context.WithCancel(ctx)
+			evict := cache.EvictKey
+			if r.Model == RedisHashesModel {
+				evict = func(key string) { cache.EvictName(hashName(key)) }
+			}
+			for _, master := range masters {
+				go watchMaster(subCtx, master, cache, evict)
+			}
+			r.waitTopologyChange(ctx, masters)
+			cancel()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		cache.Expire()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// masters of the cluster by address
+func (r *RedisKVS) masters() (map[string]*redis.Client, error) {
+	var mu sync.Mutex
+	masters := make(map[string]*redis.Client)
+	err := r.client.ForEachMaster(func(master *redis.Client) error {
+		mu.Lock()
+		masters[master.Options().Addr] = master
+		mu.Unlock()
+		return nil
 	})
-	r.client = rdb
+	return masters, err
 }
 
-// Handle : function to call on the dns server when a package is received.
-// Prepares the package and calls Redis to fill it up
-func (r *RedisKVS) Handle(w dns.ResponseWriter, req *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(req)
+// waitTopologyChange returns once ctx is done or the set of masters is no
+// longer the given one
+func (r *RedisKVS) waitTopologyChange(ctx context.Context, current map[string]*redis.Client) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.client.ReloadState(); err != nil {
+			log.Printf("Error reloading redis cluster state: %v", err)
+			continue
+		}
+		masters, err := r.masters()
+		if err != nil {
+			log.Printf("Error listing redis masters: %v", err)
+			continue
+		}
+		if len(masters) != len(current) {
+			log.Println("Redis cluster topology changed, subscribing again")
+			return
+		}
+		for addr := range masters {
+			if _, ok := current[addr]; !ok {
+				log.Println("Redis cluster topology changed, subscribing again")
+				return
+			}
+		}
+	}
+}
 
-	if r.Print {
-		logQuery(req)
+// keyspaceEvents checks that the master notifies the changes made to
+// the string or hash keys of the model and their deletion
+func keyspaceEvents(master *redis.Client, model string) error {
+	val, err := master.ConfigGet("notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	if len(val) != 2 {
+		return fmt.Errorf("notify-keyspace-events not found")
+	}
+	flags, _ := val[1].(string)
+	class := "$"
+	if model == RedisHashesModel {
+		class = "h"
 	}
+	if strings.Contains(flags, "K") &&
+		(strings.Contains(flags, "A") || strings.Contains(flags, "g") && strings.Contains(flags, class)) {
+		return nil
+	}
+	return fmt.Errorf("notify-keyspace-events is %q, needs K and A or g%s", flags, class)
+}
 
-	if req.MsgHdr.Authoritative {
-		m.Rcode = 4 // Not implemented
-		w.WriteMsg(m)
-	} else {
-		rcode := r.MakeQuery(m)
-		m.Rcode = rcode
-		w.WriteMsg(m)
+// watchMaster evicts the keys changed on a master with evict until ctx is
+// done
+func watchMaster(ctx context.Context, master *redis.Client, cache *Cache, evict func(key string)) {
+	prefix := fmt.Sprintf("__keyspace@%d__:", master.Options().DB)
+	pubsub := master.PSubscribe(prefix + "*")
+	go func() {
+		<-ctx.Done()
+		pubsub.Close()
+	}()
+	for {
+		msg, err := pubsub.Receive()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// The subscription is made again on the next Receive,
+			// changes made meanwhile are lost
+			log.Printf("Error on redis keyspace subscription %s: %v", master.Options().Addr, err)
+			cache.Expire()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if msg, ok := msg.(*redis.Message); ok {
+			evict(strings.TrimPrefix(msg.Channel, prefix))
+		}
 	}
 }
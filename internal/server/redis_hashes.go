@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"github.com/miekg/dns"
+)
+
+// SetZones : replaces the zones used as hash tags of the keys on the
+// hashes data model
+func (r *RedisKVS) SetZones(zones []string) {
+	r.zones.Store(zones)
+}
+
+// hashKey : key of the hash written with the RRsets of name, tagged with
+// the closest zone so every name of a zone is on the same slot. Names
+// outside the zones are rejected, their key couldn't be found again
+func (r *RedisKVS) hashKey(name string) (string, error) {
+	zones, _ := r.zones.Load().([]string)
+	zone := closestZone(zones, name)
+	if zone == "" {
+		return "", fmt.Errorf("no configured zone contains %s", name)
+	}
+	return "{" + zone + "}" + name, nil
+}
+
+// hashKeys : keys the hash of name may have been written with, one per
+// configured zone containing it, the closest first. The records stay
+// found when a zone below the one they were uploaded to is added later,
+// or was missing from the uploader configuration
+func (r *RedisKVS) hashKeys(name string) []string {
+	zones, _ := r.zones.Load().([]string)
+	var containing []string
+	for _, zone := range zones {
+		zone = dns.CanonicalName(zone)
+		if dns.IsSubDomain(zone, name) {
+			containing = append(containing, zone)
+		}
+	}
+	sort.Slice(containing, func(i, j int) bool {
+		return dns.CountLabel(containing[i]) > dns.CountLabel(containing[j])
+	})
+	keys := make([]string, len(containing))
+	for i, zone := range containing {
+		keys[i] = "{" + zone + "}" + name
+	}
+	return keys
+}
+
+// hashName : name whose RRsets are held on the hash key
+func hashName(key string) string {
+	if strings.HasPrefix(key, "{") {
+		if i := strings.Index(key, "}"); i > 0 {
+			return key[i+1:]
+		}
+	}
+	return key
+}
+
+// queryHash answers m on the hashes data model in one round trip, with
+// HGETALL for ANY queries and a pipelined HGET and EXISTS otherwise so a
+// name without records of the type (NODATA) is told from a missing one.
+// Every key of hashKeys is read, the first hash that exists answers, with
+// NODATA when it doesn't have the type
+func (r *RedisKVS) queryHash(ctx context.Context, m *dns.Msg) error {
+	dnsq := m.Question[0]
+	keys := r.hashKeys(dnsq.Name)
+	if len(keys) == 0 {
+		return ErrNotFound
+	}
+
+	if dnsq.Qtype == dns.TypeANY {
+		all := make([]*redis.StringStringMapCmd, len(keys))
+		err := r.read(ctx, func(rclient redis.Cmdable) error {
+			_, err := rclient.Pipelined(func(pipe redis.Pipeliner) error {
+				for i, key := range keys {
+					all[i] = pipe.HGetAll(key)
+				}
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			return backendError(ctx, "Redis", err)
+		}
+		for i, key := range keys {
+			fields := all[i].Val()
+			if len(fields) == 0 {
+				continue
+			}
+			for rrtype, value := range fields {
+				rrs, err := DecodeRRSet(dnsq.Name, dns.StringToType[rrtype], []byte(value))
+				if err != nil {
+					return corrupt("Redis", key+" "+rrtype, err)
+				}
+				m.Answer = append(m.Answer, rrs...)
+			}
+			return nil
+		}
+		return ErrNotFound
+	}
+
+	rrtype := dns.TypeToString[dnsq.Qtype]
+	gets := make([]*redis.StringCmd, len(keys))
+	exists := make([]*redis.IntCmd, len(keys))
+	err := r.read(ctx, func(rclient redis.Cmdable) error {
+		_, err := rclient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				gets[i] = pipe.HGet(key, rrtype)
+				exists[i] = pipe.Exists(key)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil && err != redis.Nil {
+		return backendError(ctx, "Redis", err)
+	}
+	for i, key := range keys {
+		value, err := gets[i].Bytes()
+		if err == redis.Nil {
+			if exists[i].Val() > 0 {
+				// The name is there without the type, NODATA
+				return nil
+			}
+			continue
+		}
+		rrs, err := DecodeRRSet(dnsq.Name, dnsq.Qtype, value)
+		if err != nil {
+			return corrupt("Redis", key+" "+rrtype, err)
+		}
+		m.Answer = append(m.Answer, rrs...)
+		return nil
+	}
+	return ErrNotFound
+}
+
+// uploadHash adds rr to its RRset on the hash of its name, in a
+// transaction retried when another client changes the hash meanwhile
+func (r *RedisKVS) uploadHash(ctx context.Context, rr dns.RR) error {
+	key, err := r.hashKey(rr.Header().Name)
+	if err != nil {
+		log.Printf("Error at redis uploading %s: %v", rr.Header().Name, err)
+		return err
+	}
+	rrtype := dns.TypeToString[rr.Header().Rrtype]
+	rclient := r.client.WithContext(ctx)
+
+	update := func(tx *redis.Tx) error {
+		var rrs []dns.RR
+		value, err := tx.HGet(key, rrtype).Bytes()
+		if err == nil {
+			rrs, err = DecodeRRSet(rr.Header().Name, rr.Header().Rrtype, value)
+			if err != nil {
+				return corrupt("Redis", key+" "+rrtype, err)
+			}
+		} else if err != redis.Nil {
+			return err
+		}
+		value, err = EncodeRRSet(mergeRRSet(rrs, rr))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(key, rrtype, value)
+			return nil
+		})
+		return err
+	}
+
+	for {
+		err = rclient.Watch(update, key)
+		if err != redis.TxFailedErr || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Error at redis uploading %s %s: %v", key, rrtype, err)
+		return err
+	}
+	return nil
+}
+
+// ZoneRecords : every record of zone on the hashes data model. The names
+// of the zone share its hash tag, so they are scanned on the master
+// holding its slot
+func (r *RedisKVS) ZoneRecords(ctx context.Context, zone string) ([]dns.RR, error) {
+	if r.Model != RedisHashesModel {
+		return nil, fmt.Errorf("zone enumeration needs the %s model", RedisHashesModel)
+	}
+	tag := "{" + dns.CanonicalName(zone) + "}"
+	pattern := globEscaper.Replace(tag) + "*"
+
+	var mu sync.Mutex
+	var records []dns.RR
+	err := r.client.WithContext(ctx).ForEachMaster(func(master *redis.Client) error {
+		master = master.WithContext(ctx)
+		var cursor uint64
+		for {
+			keys, next, err := master.Scan(cursor, pattern, 1000).Result()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				fields, err := master.HGetAll(key).Result()
+				if err != nil {
+					return err
+				}
+				for rrtype, value := range fields {
+					rrs, err := DecodeRRSet(hashName(key), dns.StringToType[rrtype], []byte(value))
+					if err != nil {
+						return corrupt("Redis", key+" "+rrtype, err)
+					}
+					mu.Lock()
+					records = append(records, rrs...)
+					mu.Unlock()
+				}
+			}
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+	return records, err
+}
+
+// globEscaper escapes the pattern characters of SCAN MATCH
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
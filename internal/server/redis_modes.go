@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Deployments the Redis driver connects to. Every mode uses a cluster
+// client, the standalone and sentinel ones over a single slot range
+// served by the primary, so the records are stored the same way in all of
+// them. Outside cluster mode the reads from replicas go through a client
+// per replica, see replicaSet
+const (
+	RedisClusterMode    = "cluster"
+	RedisSentinelMode   = "sentinel"
+	RedisStandaloneMode = "standalone"
+)
+
+// sentinelReload : how often the primary of a sentinel deployment is
+// looked up again to follow failovers, and the replicas probed
+const sentinelReload = 5 * time.Second
+
+// clusterOptions : client options for the mode. In cluster mode ips are
+// seed nodes, in standalone mode the primary followed by its replicas and
+// in sentinel mode the sentinels monitoring MasterName
+func (r *RedisKVS) clusterOptions(ips []string) *redis.ClusterOptions {
+	opt := &redis.ClusterOptions{
+		Addrs:        ips,
+		PoolSize:     r.PoolSize,
+		MaxRedirects: r.MaxRedirects,
+		DialTimeout:  r.DialTimeout,
+		ReadTimeout:  r.ReadTimeout,
+		WriteTimeout: r.WriteTimeout,
+		TLSConfig:    r.TLSConfig,
+	}
+	opt.Password, opt.OnConnect = r.password(), r.onConnect()
+	switch r.Mode {
+	case RedisStandaloneMode:
+		primary := ips[0]
+		opt.ClusterSlots = func() ([]redis.ClusterSlot, error) {
+			return singleSlot(primary), nil
+		}
+	case RedisSentinelMode:
+		opt.Addrs = nil
+		opt.ClusterSlots = func() ([]redis.ClusterSlot, error) {
+			return r.sentinelSlots(ips)
+		}
+	default:
+		opt.ReadOnly = r.ReadFromReplicas
+		opt.RouteByLatency = r.RouteByLatency
+	}
+	return opt
+}
+
+// nodeOptions : client options of the single node at addr
+func (r *RedisKVS) nodeOptions(addr string) *redis.Options {
+	return &redis.Options{
+		Addr:         addr,
+		Password:     r.password(),
+		OnConnect:    r.onConnect(),
+		PoolSize:     r.PoolSize,
+		DialTimeout:  r.DialTimeout,
+		ReadTimeout:  r.ReadTimeout,
+		WriteTimeout: r.WriteTimeout,
+		TLSConfig:    r.TLSConfig,
+	}
+}
+
+// password : AUTH password of the clients. The client only sends AUTH
+// with the password, so ACL users are authenticated by onConnect instead
+func (r *RedisKVS) password() string {
+	if r.Username != "" {
+		return ""
+	}
+	return r.Password
+}
+
+// onConnect : authenticates the ACL user on each new connection
+func (r *RedisKVS) onConnect() func(*redis.Conn) error {
+	if r.Username == "" {
+		return nil
+	}
+	return func(conn *redis.Conn) error {
+		cmd := redis.NewStatusCmd("auth", r.Username, r.Password)
+		conn.Process(cmd)
+		return cmd.Err()
+	}
+}
+
+// singleSlot : every slot served by primary
+func singleSlot(primary string) []redis.ClusterSlot {
+	return []redis.ClusterSlot{{Start: 0, End: 16383, Nodes: []redis.ClusterNode{{Addr: primary}}}}
+}
+
+// sentinelSlots asks the sentinels in turn for the primary of MasterName
+// and, when reading from replicas, its healthy replicas, which replace
+// the ones taking the reads. The sentinels take the credentials and TLS
+// of the nodes
+func (r *RedisKVS) sentinelSlots(sentinels []string) ([]redis.ClusterSlot, error) {
+	var lastErr error
+	for _, addr := range sentinels {
+		sentinel := redis.NewSentinelClient(r.nodeOptions(addr))
+		primary, replicas, err := r.sentinelNodes(sentinel)
+		sentinel.Close()
+		if err == nil {
+			r.replicas.update(replicas)
+			return singleSlot(primary), nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no sentinel knows master %s: %v", r.MasterName, lastErr)
+}
+
+func (r *RedisKVS) sentinelNodes(sentinel *redis.SentinelClient) (string, []string, error) {
+	addr, err := sentinel.GetMasterAddrByName(r.MasterName).Result()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(addr) != 2 {
+		return "", nil, fmt.Errorf("bad address of master %s: %v", r.MasterName, addr)
+	}
+	primary := net.JoinHostPort(addr[0], addr[1])
+	if !r.ReadFromReplicas {
+		return primary, nil, nil
+	}
+
+	cmd := redis.NewSliceCmd("sentinel", "slaves", r.MasterName)
+	sentinel.Process(cmd)
+	slaves, err := cmd.Result()
+	if err != nil {
+		return "", nil, err
+	}
+	var replicas []string
+	for _, slave := range slaves {
+		fields, _ := slave.([]interface{})
+		info := make(map[string]string)
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := fields[i].(string)
+			info[key], _ = fields[i+1].(string)
+		}
+		if info["ip"] == "" || info["master-link-status"] != "ok" || !healthyFlags(info["flags"]) {
+			continue
+		}
+		replicas = append(replicas, net.JoinHostPort(info["ip"], info["port"]))
+	}
+	return primary, replicas, nil
+}
+
+// healthyFlags tells if the flags sentinel gives a replica allow reading
+// from it
+func healthyFlags(flags string) bool {
+	for _, flag := range strings.Split(flags, ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return false
+		}
+	}
+	return true
+}
+
+// followNodes reloads the primary and replicas from the sentinels, or
+// probes the replicas given in standalone mode, every sentinelReload
+// until ctx is done
+func (r *RedisKVS) followNodes(ctx context.Context) {
+	ticker := time.NewTicker(sentinelReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if r.Mode != RedisSentinelMode {
+			r.replicas.probe()
+		} else if err := r.client.ReloadState(); err != nil {
+			log.Printf("Error asking the redis sentinels for %s: %v", r.MasterName, err)
+		}
+	}
+}
+
+// replicaSet : clients of the replicas taking the reads outside cluster
+// mode, where the cluster client only knows the primary. The replicas are
+// probed with ROLE, so only the nodes answering as replicas get reads
+type replicaSet struct {
+	options   func(addr string) *redis.Options
+	byLatency bool
+
+	mu      sync.RWMutex
+	clients map[string]*redis.Client
+	// Replicas answering the last probe, the fastest first
+	healthy []*redis.Client
+}
+
+func newReplicaSet(options func(addr string) *redis.Options, byLatency bool) *replicaSet {
+	return &replicaSet{
+		options:   options,
+		byLatency: byLatency,
+		clients:   make(map[string]*redis.Client),
+	}
+}
+
+// update replaces the replicas by the ones at addrs and probes them
+func (s *replicaSet) update(addrs []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		current[addr] = true
+		if _, ok := s.clients[addr]; !ok {
+			s.clients[addr] = redis.NewClient(s.options(addr))
+		}
+	}
+	for addr, client := range s.clients {
+		if !current[addr] {
+			delete(s.clients, addr)
+			client.Close()
+		}
+	}
+	s.mu.Unlock()
+	s.probe()
+}
+
+// probe sends ROLE to every replica keeping the ones answering as a
+// replica, sorted by the time they took
+func (s *replicaSet) probe() {
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	clients := make([]*redis.Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.mu.RUnlock()
+
+	var healthy []*redis.Client
+	latency := make(map[*redis.Client]time.Duration)
+	for _, client := range clients {
+		start := time.Now()
+		cmd := redis.NewSliceCmd("role")
+		client.Process(cmd)
+		role, err := cmd.Result()
+		if err == nil && (len(role) == 0 || role[0] != "slave") {
+			err = fmt.Errorf("not a replica: %v", role)
+		}
+		if err != nil {
+			log.Printf("Error probing redis replica %s, not reading from it: %v", client.Options().Addr, err)
+			continue
+		}
+		latency[client] = time.Since(start)
+		healthy = append(healthy, client)
+	}
+	sort.Slice(healthy, func(i, j int) bool { return latency[healthy[i]] < latency[healthy[j]] })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthy = s.healthy[:0]
+	for _, client := range healthy {
+		// Skip the replicas removed while probing
+		if s.clients[client.Options().Addr] == client {
+			s.healthy = append(s.healthy, client)
+		}
+	}
+}
+
+// pick : replica to read from, the fastest one by latency or a random
+// one, or nil when none is healthy
+func (s *replicaSet) pick() *redis.Client {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch {
+	case len(s.healthy) == 0:
+		return nil
+	case s.byLatency:
+		return s.healthy[0]
+	default:
+		return s.healthy[rand.Intn(len(s.healthy))]
+	}
+}
+
+// markDown stops reading from client until the next probe
+func (s *replicaSet) markDown(client *redis.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, healthy := range s.healthy {
+		if healthy == client {
+			s.healthy = append(s.healthy[:i:i], s.healthy[i+1:]...)
+			return
+		}
+	}
+}
+
+// close closes the client of every replica
+func (s *replicaSet) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, client := range s.clients {
+		client.Close()
+		delete(s.clients, addr)
+	}
+	s.healthy = nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/miekg/dns"
+)
+
+// mergeScript merges the encoded RRset ARGV[1] into the one stored on
+// KEYS[1], or on its field ARGV[3] for the hashes model, replacing it
+// instead when ARGV[2] is 1. It mirrors mergeRRSet so the merge of each
+// RRset is atomic without a WATCH round trip
+var mergeScript = redis.NewScript(`
+local current
+if ARGV[3] == '' then
+	current = redis.call('GET', KEYS[1])
+else
+	current = redis.call('HGET', KEYS[1], ARGV[3])
+end
+local set = cjson.decode(ARGV[1])
+if current and ARGV[2] ~= '1' then
+	local new = set
+	set = cjson.decode(current)
+	if set.v ~= new.v then
+		return redis.error_reply('unknown encoding version ' .. tostring(set.v))
+	end
+	for _, rr in ipairs(new.rrs) do
+		local found = false
+		for i, old in ipairs(set.rrs) do
+			if old.data == rr.data then
+				set.rrs[i] = rr
+				found = true
+				break
+			end
+		end
+		if not found then
+			table.insert(set.rrs, rr)
+		end
+	end
+end
+local value = cjson.encode(set)
+if ARGV[3] == '' then
+	redis.call('SET', KEYS[1], value)
+else
+	redis.call('HSET', KEYS[1], ARGV[3], value)
+end
+return #set.rrs
+`)
+
+// pendingRRset : records of a batch going to the same RRset
+type pendingRRset struct {
+	key     string
+	field   string
+	slot    int
+	replace bool
+	rrs     []dns.RR
+}
+
+// UploadBatch : adds the records to their RRsets. The RRsets are sorted
+// by cluster slot and merged by a script in pipelines of PipelineSize
+// commands, so most pipelines go to a single master. Records whose
+// command fails, or outside the zones with the hashes model, are returned
+// in a *BatchError
+func (r *RedisKVS) UploadBatch(ctx context.Context, rrs []dns.RR) error {
+	var sets []*pendingRRset
+	var failed []RecordError
+	byKey := make(map[string]*pendingRRset)
+	for _, rr := range rrs {
+		key, field := recordKey(rr), ""
+		if r.Model == RedisHashesModel {
+			var err error
+			if key, err = r.hashKey(rr.Header().Name); err != nil {
+				failed = append(failed, RecordError{RR: rr, Err: err})
+				continue
+			}
+			field = dns.TypeToString[rr.Header().Rrtype]
+		}
+		set, ok := byKey[key+" "+field]
+		if !ok {
+			set = &pendingRRset{key: key, field: field, slot: keySlot(key)}
+			byKey[key+" "+field] = set
+			sets = append(sets, set)
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeCNAME:
+			set.replace = true
+		}
+		set.rrs = mergeRRSet(set.rrs, rr)
+	}
+	sort.SliceStable(sets, func(i, j int) bool { return sets[i].slot < sets[j].slot })
+
+	size := r.PipelineSize
+	if size <= 0 {
+		size = len(sets)
+	}
+	for start := 0; start < len(sets); start += size {
+		end := start + size
+		if end > len(sets) {
+			end = len(sets)
+		}
+		for i, err := range r.mergePipeline(ctx, sets[start:end]) {
+			if err == nil {
+				continue
+			}
+			for _, rr := range sets[start+i].rrs {
+				failed = append(failed, RecordError{RR: rr, Err: err})
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed}
+	}
+	return nil
+}
+
+// mergePipeline runs the merge of each RRset in one pipeline returning
+// the error of each command. The script is loaded on the masters when
+// one of them doesn't have it and the failed commands sent again
+func (r *RedisKVS) mergePipeline(ctx context.Context, sets []*pendingRRset) []error {
+	errs := make([]error, len(sets))
+	pending := make([]int, len(sets))
+	for i := range sets {
+		pending[i] = i
+	}
+
+	for loaded := false; ; loaded = true {
+		cmds := make([]*redis.Cmd, len(pending))
+		r.client.WithContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+			for i, j := range pending {
+				set := sets[j]
+				value, err := EncodeRRSet(set.rrs)
+				if err != nil {
+					errs[j] = err
+					continue
+				}
+				replace := "0"
+				if set.replace {
+					replace = "1"
+				}
+				cmds[i] = mergeScript.EvalSha(pipe, []string{set.key}, value, replace, set.field)
+			}
+			return nil
+		})
+
+		var missing []int
+		for i, j := range pending {
+			if cmds[i] == nil {
+				continue
+			}
+			errs[j] = cmds[i].Err()
+			if errs[j] != nil && strings.HasPrefix(errs[j].Error(), "NOSCRIPT") {
+				missing = append(missing, j)
+			}
+		}
+		if len(missing) == 0 || loaded {
+			return errs
+		}
+		err := r.client.WithContext(ctx).ForEachMaster(func(master *redis.Client) error {
+			return mergeScript.Load(master).Err()
+		})
+		if err != nil {
+			for _, j := range missing {
+				errs[j] = err
+			}
+			return errs
+		}
+		pending = missing
+	}
+}
+
+// keySlot : cluster slot of key, the CRC16 of its hash tag when it has
+// one or of the whole key modulo 16384
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % 16384
+}
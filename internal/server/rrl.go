@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dario617/goKvsDns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// Actions taken by the rate limiter on a response
+const (
+	rrlSend = iota
+	rrlDrop
+	rrlSlip
+)
+
+// Response types accounted on separate buckets
+const (
+	rrlAnswer   = "answer"
+	rrlNodata   = "nodata"
+	rrlNxdomain = "nxdomain"
+	rrlError    = "error"
+)
+
+// RateLimiter : Response Rate Limiting for UDP answers. Keeps an account
+// for each client prefix and response type, credited ResponsesPerSecond
+// each second up to ResponsesPerSecond and debited every response, as
+// BIND and Knot do. While the account is negative the response is
+// dropped, except every Slip responses that are sent truncated so real
+// clients retry over TCP. The debt is capped at Window seconds of
+// responses, so a client is limited at most Window seconds after its
+// flood stops.
+type RateLimiter struct {
+	ResponsesPerSecond int
+	Window             int
+	Slip               int
+	IPv4PrefixLen      int
+	IPv6PrefixLen      int
+
+	exempt    []*net.IPNet
+	mu        sync.Mutex
+	buckets   map[string]*rrlBucket
+	lastSweep time.Time
+}
+
+type rrlBucket struct {
+	tokens  float64
+	updated time.Time
+	limited int
+}
+
+// NewRateLimiter : creates a rate limiter with the usual defaults
+// of a 15 second window, slip 2 and /24 or /56 client prefixes
+func NewRateLimiter(responsesPerSecond int) *RateLimiter {
+	return &RateLimiter{
+		ResponsesPerSecond: responsesPerSecond,
+		Window:             15,
+		Slip:               2,
+		IPv4PrefixLen:      24,
+		IPv6PrefixLen:      56,
+		buckets:            make(map[string]*rrlBucket),
+		lastSweep:          time.Now(),
+	}
+}
+
+// Exempt : clients on the comma separated CIDR list are never limited
+func (rl *RateLimiter) Exempt(cidrs string) error {
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("rrl exemption %s: %v", cidr, err)
+		}
+		rl.exempt = append(rl.exempt, network)
+	}
+	return nil
+}
+
+// rateLimiterFromConfig returns nil when rate limiting is disabled
+func rateLimiterFromConfig(cfg config.RRL) (*RateLimiter, error) {
+	if cfg.ResponsesPerSecond <= 0 {
+		return nil, nil
+	}
+	rl := NewRateLimiter(cfg.ResponsesPerSecond)
+	rl.Window = cfg.Window
+	rl.Slip = cfg.Slip
+	rl.IPv4PrefixLen = cfg.IPv4PrefixLen
+	rl.IPv6PrefixLen = cfg.IPv6PrefixLen
+	if err := rl.Exempt(strings.Join(cfg.Exempt, ",")); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// check decides if the response m to addr should be sent, dropped or
+// sent truncated. Only UDP responses are limited.
+func (rl *RateLimiter) check(addr net.Addr, m *dns.Msg) int {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok || rl.ResponsesPerSecond <= 0 {
+		return rrlSend
+	}
+	for _, network := range rl.exempt {
+		if network.Contains(udp.IP) {
+			return rrlSend
+		}
+	}
+
+	key := rl.prefix(udp.IP) + "/" + responseType(m)
+	now := time.Now()
+	rate := float64(rl.ResponsesPerSecond)
+	debt := -rate * float64(rl.Window)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.sweep(now)
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &rrlBucket{tokens: rate, updated: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.updated = now
+
+	// Every response is accounted, dropped ones too
+	b.tokens--
+	if b.tokens < debt {
+		b.tokens = debt
+	}
+	if b.tokens >= 0 {
+		b.limited = 0
+		return rrlSend
+	}
+
+	b.limited++
+	if rl.Slip > 0 && b.limited%rl.Slip == 0 {
+		rrlSlipped.Add(1)
+		return rrlSlip
+	}
+	rrlDropped.Add(1)
+	return rrlDrop
+}
+
+// sweep forgets buckets unused for a whole window, which has repaid any
+// debt
+func (rl *RateLimiter) sweep(now time.Time) {
+	window := time.Duration(rl.Window) * time.Second
+	if now.Sub(rl.lastSweep) < window {
+		return
+	}
+	for key, b := range rl.buckets {
+		if now.Sub(b.updated) > window {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// prefix masks the client address to the configured prefix length
+func (rl *RateLimiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rl.IPv4PrefixLen, 32)).String() + "/" + strconv.Itoa(rl.IPv4PrefixLen)
+	}
+	return ip.Mask(net.CIDRMask(rl.IPv6PrefixLen, 128)).String() + "/" + strconv.Itoa(rl.IPv6PrefixLen)
+}
+
+func responseType(m *dns.Msg) string {
+	switch m.Rcode {
+	case dns.RcodeSuccess:
+		if len(m.Answer) == 0 {
+			return rrlNodata
+		}
+		return rrlAnswer
+	case dns.RcodeNameError:
+		return rrlNxdomain
+	}
+	return rrlError
+}
+
+// slipReply : empty truncated reply asking the client to retry over TCP
+func slipReply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Truncated = true
+	return m
+}
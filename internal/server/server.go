@@ -1,22 +1,162 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/dario617/goKvsDns/internal/config"
+	"github.com/gocql/gocql"
 	"github.com/miekg/dns"
 )
 
-// DBDriver : Database driver interface
+// DBDriver : Database driver interface. Queries and uploads stop when
+// their context is done
 type DBDriver interface {
-	MakeQuery(m *dns.Msg) int
-	UploadRR(line string) error
-	HandleFile(location string, replace bool)
+	MakeQuery(ctx context.Context, m *dns.Msg) error
+	UploadRR(ctx context.Context, line string) error
+	// UploadBatch adds many records to their RRsets with the fewest
+	// requests the database allows. A *BatchError tells the records that
+	// failed when the others were uploaded
+	UploadBatch(ctx context.Context, rrs []dns.RR) error
+	HandleFile(ctx context.Context, location string, replace bool)
 	ConnectDB(ips []string)
 	Disconnect()
-	Handle(w dns.ResponseWriter, r *dns.Msg)
+	// Ping checks that the database can answer requests
+	Ping(ctx context.Context) error
+}
+
+// ZoneAware : drivers that need the names of the configured zones
+type ZoneAware interface {
+	SetZones(zones []string)
+}
+
+// Handler : dns.Handler shared by every driver. Prepares the reply,
+// checks access, calls the driver to fill it up, rate limits and logs
+// the exchange. Everything but the driver can be replaced with Reload
+// while serving.
+type Handler struct {
+	Driver DBDriver
+	// Deadline of the driver query made for each request
+	QueryTimeout time.Duration
+	state        atomic.Value // *handlerState
+	keyring      *tsigKeyring
+	inflight     int64
+
+	// Cancelled on Close to abort the queries still running
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// handlerState holds the reloadable parts of the handler
+type handlerState struct {
+	print bool
+	tap   *DnstapLogger
+	rrl   *RateLimiter
+	acl   *AccessControl
+}
+
+// ServeDNS : function to call on the dns server when a package is received
+func (h *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	atomic.AddInt64(&h.inflight, 1)
+	defer atomic.AddInt64(&h.inflight, -1)
+
+	st := h.state.Load().(*handlerState)
+	received := time.Now()
+	tapped := st.tap.Sample()
+	if tapped {
+		st.tap.LogQuery(w, r, received)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if st.print {
+		logQuery(r)
+	}
+
+	if st.acl != nil {
+		if tsig := st.acl.verified(w, r); tsig != nil {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+		}
+	}
+
+	switch {
+	case st.acl != nil && !st.acl.allowed(w, r):
+		m.Rcode = 5 // Refused
+	case r.MsgHdr.Authoritative || operation(r) != OpQuery:
+		m.Rcode = 4 // Not implemented
+	default:
+		ctx, cancel := context.WithTimeout(h.ctx, h.QueryTimeout)
+		setError(r, m, h.Driver.MakeQuery(ctx, m))
+		cancel()
+	}
+
+	if st.rrl != nil {
+		switch st.rrl.check(w.RemoteAddr(), m) {
+		case rrlDrop:
+			return
+		case rrlSlip:
+			m = slipReply(r)
+		}
+	}
+	w.WriteMsg(m)
+
+	if tapped {
+		st.tap.LogResponse(w, m, received)
+	}
+}
+
+// Reload : replaces the logging, rate limiting, zones, ACLs and TSIG keys
+// with the ones of cfg. Queries being served finish with the old values.
+func (h *Handler) Reload(cfg *config.Config) error {
+	old, _ := h.state.Load().(*handlerState)
+	st, err := newHandlerState(cfg, old)
+	if err != nil {
+		return err
+	}
+
+	var keys map[string]string
+	if st.acl != nil {
+		keys = st.acl.Keys
+	}
+	h.keyring.set(keys)
+	h.state.Store(st)
+	if driver, ok := h.Driver.(ZoneAware); ok {
+		driver.SetZones(cfg.ZoneNames())
+	}
+
+	if old != nil && old.tap != nil && old.tap != st.tap {
+		old.tap.Close()
+	}
+	return nil
+}
+
+// Close : cancels the queries in flight and stops the dnstap output
+func (h *Handler) Close() {
+	h.cancel()
+	if st, ok := h.state.Load().(*handlerState); ok && st.tap != nil {
+		st.tap.Close()
+	}
+}
+
+// drain waits until no query is being served or the context is done
+func (h *Handler) drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&h.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d queries still in flight: %v", atomic.LoadInt64(&h.inflight), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
 }
 
 // Unified query logging
@@ -24,50 +164,234 @@ func logQuery(m *dns.Msg) {
 	log.Printf("%v\n", m.String())
 }
 
-func serve(net string, soreuseport bool, port int) {
-	server := &dns.Server{Addr: "[::]:" + strconv.Itoa(port), Net: net, TsigSecret: nil, ReusePort: soreuseport}
-	log.Printf("Starting a server on port %d...\n", port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Failed to setup the "+net+" server: %s\n", err.Error())
+// Server : DNS listeners sharing a handler and its database driver
+type Server struct {
+	Handler   *Handler
+	Driver    DBDriver
+	listeners []*dns.Server
+	errors    chan error
+	health    *http.Server
+	stopping  int32
+	// Stops the cache invalidation of the driver
+	stopWatch context.CancelFunc
+}
+
+// Errors : listeners that fail to start or stop unexpectedly report here
+func (s *Server) Errors() <-chan error {
+	return s.errors
+}
+
+func (s *Server) serve(net string, soreuseport bool, port int) {
+	server := &dns.Server{
+		Addr:         "[::]:" + strconv.Itoa(port),
+		Net:          net,
+		Handler:      s.Handler,
+		TsigProvider: s.Handler.keyring,
+		ReusePort:    soreuseport,
+	}
+	s.listeners = append(s.listeners, server)
+	go func() {
+		log.Printf("Starting a server on port %d...\n", port)
+		if err := server.ListenAndServe(); err != nil {
+			s.errors <- fmt.Errorf("%s server on port %d: %v", net, port, err)
+		}
+	}()
+}
+
+// Shutdown : stops the listeners, waits for the queries in flight until
+// ctx is done and then disconnects the database and closes the logs
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.stopping, 1)
+	var firstErr error
+	for _, listener := range s.listeners {
+		if err := listener.ShutdownContext(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := s.Handler.drain(ctx); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if s.health != nil {
+		s.health.Close()
+	}
+	if s.stopWatch != nil {
+		s.stopWatch()
 	}
+	s.Handler.Close()
+	s.Driver.Disconnect()
+	return firstErr
 }
 
-// Start server
-func Start(db, rawIps string, soreuseport, port int, verbose bool) DBDriver {
+// NewDriver : creates the driver selected on the backend configuration.
+// The driver still needs to be connected with ConnectDB
+func NewDriver(cfg config.Backend, verbose bool) DBDriver {
+	auth, tlsOpts := cfg.Security()
+	password, err := auth.Secret()
+	if err != nil {
+		log.Fatalf("Couldn't read the %s password: %v", cfg.DB, err)
+	}
+	tlsConfig, err := tlsOpts.ClientConfig()
+	if err != nil {
+		log.Fatalf("Couldn't load the %s TLS files: %v", cfg.DB, err)
+	}
 
-	var ips []string = strings.Split(rawIps, ",")
 	var driver DBDriver
-	switch db {
+	switch cfg.DB {
 	case "cassandra":
 		var d *CassandraDB = new(CassandraDB)
 		d.Print = verbose
+		d.Keyspace = cfg.Cassandra.Keyspace
+		d.ReadConsistency = gocql.ParseConsistency(cfg.Cassandra.ReadConsistency)
+		d.WriteConsistency = gocql.ParseConsistency(cfg.Cassandra.WriteConsistency)
+		d.LocalDC = cfg.Cassandra.LocalDC
+		d.AutoMigrate = cfg.Cassandra.Migrate
+		d.Model = cfg.Cassandra.Model
+		d.Replication = map[string]string{"class": cfg.Cassandra.Replication.Class}
+		if cfg.Cassandra.Replication.Class == "SimpleStrategy" {
+			d.Replication["replication_factor"] = strconv.Itoa(cfg.Cassandra.Replication.Factor)
+		} else {
+			for dc, factor := range cfg.Cassandra.Replication.DataCenters {
+				d.Replication[dc] = strconv.Itoa(factor)
+			}
+		}
+		d.Timeout = cfg.Cassandra.Timeout
+		d.ConnectTimeout = cfg.Cassandra.ConnectTimeout
+		d.NumConns = cfg.Cassandra.NumConns
+		d.WriteAttempts = cfg.Cassandra.WriteAttempts
+		d.ReadRetries = cfg.Cassandra.ReadRetries
+		d.MinBackoff = cfg.Cassandra.MinBackoff
+		d.MaxBackoff = cfg.Cassandra.MaxBackoff
+		d.SpeculativeAttempts = cfg.Cassandra.SpeculativeAttempts
+		d.SpeculativeDelay = cfg.Cassandra.SpeculativeDelay
+		d.BatchSize = cfg.Cassandra.BatchSize
+		d.BatchConcurrency = cfg.Cassandra.BatchConcurrency
+		d.Username = auth.Username
+		d.Password = password
+		d.TLSConfig = tlsConfig
 		driver = d
 	case "redis":
 		var d *RedisKVS = new(RedisKVS)
 		d.Print = verbose
+		d.PoolSize = cfg.Redis.PoolSize
+		d.MaxRedirects = cfg.Redis.MaxRedirects
+		d.DialTimeout = cfg.Redis.DialTimeout
+		d.ReadTimeout = cfg.Redis.ReadTimeout
+		d.WriteTimeout = cfg.Redis.WriteTimeout
+		d.Model = cfg.Redis.Model
+		d.PipelineSize = cfg.Redis.PipelineSize
+		d.Mode = cfg.Redis.Mode
+		d.MasterName = cfg.Redis.MasterName
+		d.ReadFromReplicas = cfg.Redis.ReadFromReplicas
+		d.RouteByLatency = cfg.Redis.RouteByLatency
+		d.Username = auth.Username
+		d.Password = password
+		d.TLSConfig = tlsConfig
+		// The client doesn't honor deadlines, bound the socket reads instead
+		if d.ReadTimeout == 0 {
+			d.ReadTimeout = cfg.QueryTimeout
+		}
 		driver = d
 	case "etcd":
 		var d *EtcdDB = new(EtcdDB)
 		d.Print = verbose
-		d.Timeout = 10 * time.Second // Generous times for stressfull scenarios
+		d.Timeout = cfg.Etcd.Timeout
+		d.DialTimeout = cfg.Etcd.DialTimeout
+		d.MaxTxnOps = cfg.Etcd.MaxTxnOps
+		d.MaxRequestBytes = cfg.Etcd.MaxRequestBytes
+		d.WriteAttempts = cfg.Etcd.WriteAttempts
+		d.MinBackoff = cfg.Etcd.MinBackoff
+		d.MaxBackoff = cfg.Etcd.MaxBackoff
+		d.Username = auth.Username
+		d.Password = password
+		d.TLSConfig = tlsConfig
 		driver = d
 	}
+	return driver
+}
+
+// NewHandler : creates the handler with the logging, rate limiting and
+// access control of the configuration. The driver is set by Start
+func NewHandler(cfg *config.Config) (*Handler, error) {
+	h := &Handler{keyring: newTsigKeyring(), QueryTimeout: cfg.Backend.QueryTimeout}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	if err := h.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// newHandlerState builds the state for cfg. The dnstap output of old is
+// kept when its options didn't change
+func newHandlerState(cfg *config.Config, old *handlerState) (*handlerState, error) {
+	st := &handlerState{print: cfg.Logging.Print}
+
+	rrl, err := rateLimiterFromConfig(cfg.RRL)
+	if err != nil {
+		return nil, err
+	}
+	st.rrl = rrl
+
+	acl, err := accessControlFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	st.acl = acl
+
+	tapCfg := cfg.Logging.Dnstap
+	switch {
+	case tapCfg.Target == "":
+	case old != nil && old.tap.sameOptions(tapCfg.Target, tapCfg.Sample, tapCfg.Buffer):
+		st.tap = old.tap
+	default:
+		tap, err := NewDnstapLogger(tapCfg.Target, tapCfg.Sample, tapCfg.Buffer)
+		if err != nil {
+			return nil, err
+		}
+		st.tap = tap
+	}
+	return st, nil
+}
 
-	driver.ConnectDB(ips)
-	log.Printf("DB %s connected for cluster %v\n", db, ips)
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		driver.Handle(w, r)
-	})
+// Start server. Connects the driver for the backend and serves the
+// handler on the configured listeners
+func Start(cfg *config.Config, handler *Handler) *Server {
 
-	if soreuseport > 0 {
+	driver := NewDriver(cfg.Backend, cfg.Logging.Print)
+	if zoned, ok := driver.(ZoneAware); ok {
+		zoned.SetZones(cfg.ZoneNames())
+	}
+	driver.ConnectDB(cfg.Backend.ClusterIPs)
+	log.Printf("DB %s connected for cluster %v\n", cfg.Backend.DB, cfg.Backend.ClusterIPs)
+	s := &Server{Handler: handler, errors: make(chan error, 2*cfg.Listen.ReusePort+2)}
+	// Concurrent queries of an RRset share a driver query, with or without
+	// the cache in front
+	coalesced := NewCoalescedDriver(driver, strings.Title(cfg.Backend.DB), cfg.Backend.QueryTimeout)
+	var serving DBDriver = coalesced
+	if cfg.Cache.MaxBytes > 0 {
+		cache := NewCache(cfg.Cache.MaxBytes, cfg.Cache.MaxTTL, cfg.Cache.Shards)
+		cache.StaleWindow = cfg.Cache.StaleWindow
+		cache.StaleTTL = uint32(cfg.Cache.StaleTTL / time.Second)
+		if invalidator, ok := driver.(Invalidator); ok {
+			var ctx context.Context
+			ctx, s.stopWatch = context.WithCancel(context.Background())
+			go invalidator.WatchChanges(ctx, cache)
+		}
+		cached := NewCachedDriver(coalesced, cache, cfg.ZoneNames(), cfg.Cache.NegativeTTL)
+		cached.StaleRetry = cfg.Cache.StaleRetry
+		serving = cached
+	}
+	handler.Driver = serving
+	s.Driver = serving
+	port := cfg.Listen.Port
+	if soreuseport := cfg.Listen.ReusePort; soreuseport > 0 {
 		for i := 0; i < soreuseport; i++ {
-			go serve("tcp", true, port)
-			go serve("udp", true, port)
+			s.serve("tcp", true, port)
+			s.serve("udp", true, port)
 		}
 	} else {
-		go serve("tcp", false, port)
-		go serve("udp", false, port)
+		s.serve("tcp", false, port)
+		s.serve("udp", false, port)
 	}
 
-	return driver
+	return s
 }
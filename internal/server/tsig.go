@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// tsigKeyring : dns.TsigProvider for the listeners whose secrets can be
+// replaced on reload while the servers keep running
+type tsigKeyring struct {
+	keys atomic.Value // map[string]string, base64 secrets by key name
+}
+
+func newTsigKeyring() *tsigKeyring {
+	k := new(tsigKeyring)
+	k.keys.Store(map[string]string{})
+	return k
+}
+
+// set replaces every secret of the keyring
+func (k *tsigKeyring) set(keys map[string]string) {
+	if keys == nil {
+		keys = map[string]string{}
+	}
+	k.keys.Store(keys)
+}
+
+// Generate : HMAC of msg with the secret of the TSIG key
+func (k *tsigKeyring) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	secret, ok := k.keys.Load().(map[string]string)[dns.CanonicalName(t.Hdr.Name)]
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch dns.CanonicalName(t.Algorithm) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, raw)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, raw)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, raw)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, raw)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, raw)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// Verify : checks the MAC of the TSIG record against msg
+func (k *tsigKeyring) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := k.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
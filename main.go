@@ -8,10 +8,28 @@
 // acting as an authorative DNS server.
 //
 // Basic use pattern:
-//  go-kvs-dns-server --clusterIPs "192.168.0.240,192.168.0.241,192.168.0.242" \
-//    --print --db cassandra --port 8053
+//
+//	go-kvs-dns-server --clusterIPs "192.168.0.240,192.168.0.241,192.168.0.242" \
+//	  --print --db cassandra --port 8053
+//
+// or with a configuration file, where flags given on the command line
+// override the values of the file:
+//
+//	go-kvs-dns-server --config kvsdns.yml
+//	go-kvs-dns-server --config kvsdns.yml --check-config
+//
+// The Cassandra keyspace and tables are created, or upgraded to the
+// schema of this version, and the etcd and Redis records stored by earlier
+// releases converted to the current encoding with:
+//
+//	go-kvs-dns-server --config kvsdns.yml migrate
+//
+// and the records copied to the tables of the zones data model with:
+//
+//	go-kvs-dns-server --config kvsdns.yml migrate copy-records
 //
 // then:
+//
 //	dig @localhost -p 8053 this.is.my.domain.andhael.cl A
 //
 //	;; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 2157
@@ -29,27 +47,44 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"reflect"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"syscall"
+	"time"
 
+	"github.com/dario617/goKvsDns/internal/config"
 	"github.com/dario617/goKvsDns/internal/server"
 )
 
 var (
+	configFile  = flag.String("config", "", "YAML configuration file")
+	checkConfig = flag.Bool("check-config", false, "validate the configuration and exit")
 	cpuprofile  = flag.String("cpuprofile", "", "write cpu profile to file")
 	printf      = flag.Bool("print", false, "print replies")
 	port        = flag.Int("port", 8053, "port to use")
 	soreuseport = flag.Int("soreuseport", 0, "use SO_REUSE_PORT")
 	cpu         = flag.Int("cpu", 0, "number of cpu to use")
-	db          = flag.String("db", "cassandra", "db to connect: cassandra|redis|pebble")
+	db          = flag.String("db", "cassandra", "db to connect: cassandra|redis|etcd")
 	clusterIPs  = flag.String("clusterIPs", "192.168.0.240,192.168.0.241,192.168.0.242", "comma separated IP list")
+	queryTime   = flag.Duration("queryTimeout", time.Second, "deadline of each database query")
+	dnstapOut   = flag.String("dnstap", "", "dnstap output: unix:/path/to.sock, tcp:host:port or a file name")
+	dnstapRate  = flag.Int("dnstapSample", 1, "log one out of every n queries to dnstap")
+	dnstapBuf   = flag.Int("dnstapBuffer", 4096, "dnstap messages to buffer before dropping")
+	rrlRate     = flag.Int("rrl", 0, "responses per second allowed to each client prefix, 0 disables rate limiting")
+	rrlWindow   = flag.Int("rrlWindow", 15, "seconds a client prefix stays limited at most after exceeding the rate")
+	rrlSlip     = flag.Int("rrlSlip", 2, "send every n limited responses truncated instead of dropping them, 0 drops all")
+	rrlExempt   = flag.String("rrlExempt", "", "comma separated CIDR list never rate limited")
+	metrics     = flag.String("metrics", "", "address to serve metrics on, e.g. :9153")
+	health      = flag.String("health", "", "address to serve /healthz and /readyz on, e.g. :8080")
+	cacheSize   = flag.Int64("cache", 0, "bytes of memory for the RRset cache, 0 disables it")
 )
 
 func main() {
@@ -57,6 +92,20 @@ func main() {
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+
+	cfg, err := config.FromFlags(*configFile, flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *checkConfig {
+		fmt.Println("Configuration OK")
+		return
+	}
+	if flag.Arg(0) == "migrate" {
+		migrate(cfg)
+		return
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -66,11 +115,23 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if *cpu != 0 {
-		runtime.GOMAXPROCS(*cpu)
+	if cfg.Listen.CPU != 0 {
+		runtime.GOMAXPROCS(cfg.Listen.CPU)
+	}
+
+	if cfg.Metrics != "" {
+		server.ServeMetrics(cfg.Metrics)
+	}
+
+	handler, err := server.NewHandler(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	var driver = server.Start(*db, *clusterIPs, *soreuseport, *port, *printf)
+	srv := server.Start(cfg, handler)
+	if cfg.Health.Listen != "" {
+		srv.ServeHealth(cfg.Health.Listen, cfg.Health.LatencyBudget)
+	}
 	pid := os.Getpid()
 	f, err := os.OpenFile("kvsDns.pid", os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -82,11 +143,80 @@ func main() {
 	}
 	defer f.Close()
 
-	defer driver.Disconnect()
+	log.Println("Waiting for requests, SIGHUP to reload or SIGINT to stop")
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				cfg = reload(cfg, handler)
+				continue
+			}
+			fmt.Printf("\nSignal (%s) received, stopping\n", s)
+		case err := <-srv.Errors():
+			log.Printf("Listener failed, stopping: %v", err)
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Listen.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+}
 
-	log.Println("Waiting for requests or SIGINT")
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	s := <-sig
-	fmt.Printf("\nSignal (%s) received, stopping\n", s)
+// reload reads the configuration again and applies it to the handler,
+// returning the configuration in use. Listener, backend, metrics, health
+// and cache changes only take effect after a restart
+func reload(current *config.Config, handler *server.Handler) *config.Config {
+	cfg, err := config.FromFlags(*configFile, flag.CommandLine)
+	if err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %v", err)
+		return current
+	}
+	if !reflect.DeepEqual(cfg.Listen, current.Listen) || !reflect.DeepEqual(cfg.Backend, current.Backend) ||
+		cfg.Metrics != current.Metrics || cfg.Health != current.Health || cfg.Cache != current.Cache {
+		log.Println("Listen, backend, metrics, health and cache changes need a restart to take effect")
+	}
+	cfg.Listen, cfg.Backend, cfg.Metrics = current.Listen, current.Backend, current.Metrics
+	cfg.Health, cfg.Cache = current.Health, current.Cache
+	if err := handler.Reload(cfg); err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %v", err)
+		return current
+	}
+	log.Println("Configuration reloaded")
+	return cfg
+}
+
+// migrate creates or upgrades the schema of the backend, converting the
+// records of earlier releases, and, when asked, copies the records to the
+// zones data model
+func migrate(cfg *config.Config) {
+	driver := server.NewDriver(cfg.Backend, cfg.Logging.Print)
+	if zoned, ok := driver.(server.ZoneAware); ok {
+		zoned.SetZones(cfg.ZoneNames())
+	}
+	migrator, ok := driver.(server.Migrator)
+	if !ok {
+		log.Printf("Backend %s has nothing to migrate", cfg.Backend.DB)
+		return
+	}
+	if err := migrator.Migrate(cfg.Backend.ClusterIPs); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	if flag.Arg(1) != "copy-records" {
+		return
+	}
+	cassandra, ok := driver.(*server.CassandraDB)
+	if !ok {
+		log.Fatalf("Backend %s has a single data model", cfg.Backend.DB)
+	}
+	cassandra.ConnectDB(cfg.Backend.ClusterIPs)
+	defer cassandra.Disconnect()
+	if err := cassandra.CopyRecords(context.Background()); err != nil {
+		log.Fatalf("Copying the records failed: %v", err)
+	}
 }